@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/roman-mazur/architecture-practice-4-template/db/datastore"
+)
+
+type batchOperation struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+	jsonValue
+}
+
+// handleBatch atomically applies a JSON list of operations:
+// [{"op": "put", "key": "team", "value": "gods"}, {"op": "delete", "key": "old"}].
+func handleBatch(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "This method is not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ops []batchOperation
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		sendResponse(rw, nil, err)
+		return
+	}
+	wb, err := newWriteBatch(ops)
+	if err != nil {
+		sendResponse(rw, nil, err)
+		return
+	}
+	sendResponse(rw, nil, db.Batch(wb))
+}
+
+func newWriteBatch(ops []batchOperation) (*datastore.WriteBatch, error) {
+	wb := new(datastore.WriteBatch)
+	for i, op := range ops {
+		if op.Key == "" {
+			return nil, fmt.Errorf("operation %d: empty key", i)
+		}
+
+		switch op.Op {
+		case "put":
+			value, err := op.decode()
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %w", i, err)
+			}
+			switch value := value.(type) {
+			case int64:
+				wb.PutInt64(op.Key, value)
+			case []byte:
+				wb.PutBytes(op.Key, value)
+			default:
+				if value == "" {
+					return nil, fmt.Errorf("operation %d: can't save empty value", i)
+				}
+				wb.Put(op.Key, value.(string))
+			}
+		case "delete":
+			wb.Delete(op.Key)
+		default:
+			return nil, fmt.Errorf("operation %d: unknown operation %q", i, op.Op)
+		}
+	}
+	return wb, nil
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/roman-mazur/architecture-practice-4-template/db/datastore"
 	"github.com/roman-mazur/architecture-practice-4-template/httptools"
@@ -13,45 +18,247 @@ import (
 )
 
 var (
-	port = flag.Int("port", 8100, "server port")
-	db   *datastore.Db
+	port          = flag.Int("port", 8100, "server port")
+	dir           = flag.String("dir", "./out", "data directory")
+	segmentSize   = flag.Int64("segment-size", datastore.DefaultOptions().SegmentSize, "segment size in bytes")
+	segmentPrefix = flag.String("segment-prefix", datastore.DefaultOptions().SegmentPrefix, "segment file name prefix")
+	compaction    = flag.String("compaction", "segments", "when segments are merged: segments (by -merge-segments and -merge-ratio), tiered, garbage or manual")
+	mergeSegments = flag.Int("merge-segments", 2, "merge segments when there are more of them, 0 to disable")
+	mergeRatio    = flag.Float64("merge-ratio", 0, "merge segments when the newer sealed ones are this many times bigger than the oldest, 0 to disable")
+	mergeTier     = flag.Int("merge-tier", 4, "number of similar sized segments merged by -compaction=tiered")
+	mergeGarbage  = flag.Float64("merge-garbage", 0.5, "share of dead bytes in the sealed segments that starts a merge with -compaction=garbage")
+	syncMode      = flag.String("sync", "never", "when segment writes are synced to the disk: never, always or interval")
+	syncInterval  = flag.Duration("sync-interval", 10*time.Millisecond, "group commit interval for -sync=interval")
+	cacheSize     = flag.Int64("cache-size", 0, "read cache size in bytes, 0 to disable")
+	compress      = flag.Bool("compress", false, "gzip large values in the segments")
+	primary       = flag.String("primary", "", "URL of the primary db to replicate, like http://db:8100; the replica is read-only and has no buckets")
+	readOnlyMode  = flag.Bool("read-only", false, "serve the data directory without changing it, other read-only dbs can share it")
+	replInterval  = flag.Duration("replication-interval", 100*time.Millisecond, "how often a caught up replica polls the primary")
+	keepDeleted   = flag.Bool("keep-tombstones", false, "keep deleted and expired records in merges, for a primary whose replicas may lag behind after its restart")
+	db            *datastore.Db
 )
 
 func main() {
 	flag.Parse()
-	var err error
-	db, err = datastore.NewDb("./out")
+	opts, err := options()
 	if err != nil {
 		panic(err)
 	}
-	startServer()
+	if *readOnlyMode {
+		if *primary != "" {
+			panic("a replica can't be read-only")
+		}
+		db, err = datastore.OpenReadOnlyWithOptions(*dir, opts)
+	} else {
+		db, err = datastore.NewDbWithOptions(*dir, opts)
+	}
+	if err != nil {
+		panic(err)
+	}
+	var f *follower
+	if *primary != "" {
+		f, err = newFollower(strings.TrimSuffix(*primary, "/"), *replInterval)
+		if err != nil {
+			panic(err)
+		}
+		go f.run()
+	}
+	startServer(f)
 	signal.WaitForTerminationSignal()
 }
 
-func startServer() {
+func options() (datastore.Options, error) {
+	opts := datastore.DefaultOptions()
+	mode, err := datastore.ParseSyncMode(*syncMode)
+	if err != nil {
+		return opts, err
+	}
+	opts.SegmentSize = *segmentSize
+	opts.SegmentPrefix = *segmentPrefix
+	opts.Compaction, err = compactionPolicy()
+	if err != nil {
+		return opts, err
+	}
+	opts.Durability = datastore.Durability{
+		Mode:     mode,
+		Interval: *syncInterval,
+	}
+	opts.CacheSize = *cacheSize
+	opts.Compression = *compress
+	opts.KeepTombstones = *keepDeleted
+	return opts, nil
+}
+
+func compactionPolicy() (datastore.CompactionPolicy, error) {
+	switch *compaction {
+	case "segments":
+		return datastore.CompactionTrigger{
+			MaxSegments: *mergeSegments,
+			SizeRatio:   *mergeRatio,
+		}, nil
+	case "tiered":
+		return datastore.SizeTiered{MinSegments: *mergeTier}, nil
+	case "garbage":
+		return datastore.GarbageRatio{Ratio: *mergeGarbage}, nil
+	case "manual":
+		return datastore.ManualCompaction{}, nil
+	default:
+		return nil, fmt.Errorf("unknown compaction policy %q", *compaction)
+	}
+}
+
+// startServer serves a primary db when f is nil and a read-only replica otherwise.
+func startServer(f *follower) {
 	handler := http.NewServeMux()
-	handler.HandleFunc("/db/", handleDb)
+	if f == nil && !*readOnlyMode {
+		handler.HandleFunc("/db/", handleDb)
+		handler.HandleFunc("/db/_batch", handleBatch)
+	} else {
+		handler.HandleFunc("/db/", readOnly(handleDb))
+		handler.HandleFunc("/db/_batch", readOnly(handleBatch))
+	}
+	if f != nil {
+		handler.HandleFunc("/db/_replication", f.handleStatus)
+	}
+	handler.HandleFunc("/db/_log", handleLog)
+	handler.HandleFunc("/db/_compact", handleCompact)
+	handler.HandleFunc("/db/_snapshot", handleSnapshot)
+	handler.HandleFunc("/db/_cache", func(rw http.ResponseWriter, r *http.Request) {
+		sendResponse(rw, db.CacheStats(), nil)
+	})
+	handler.HandleFunc("/db/_stats", func(rw http.ResponseWriter, r *http.Request) {
+		sendResponse(rw, db.Stats(), nil)
+	})
+	handler.HandleFunc("/metrics", handleMetrics)
 	server := httptools.CreateServer(*port, handler)
 	server.Start()
 }
 
+// handleDb serves the keys of the default bucket as /db/<key> and the keys of
+// the named buckets as /db/<bucket>/<key>.
 func handleDb(rw http.ResponseWriter, r *http.Request) {
-	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(rw, "This method is not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Only writes create buckets, reads of a missing one find nothing.
+	store, key, incr, err := target(strings.TrimPrefix(r.URL.EscapedPath(), "/db/"), r.Method == http.MethodPost)
+	if err != nil {
+		sendResponse(rw, nil, err)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
-		data, err := get(key)
+		var (
+			data interface{}
+			err  error
+		)
+		if key == "" {
+			data, err = scan(store, r)
+		} else if isOctetStream(r.Header.Get("Accept")) {
+			getStream(rw, store, key)
+			return
+		} else {
+			var version uint64
+			data, version, err = get(store, key)
+			if err == nil {
+				rw.Header().Set("ETag", etag(version))
+			}
+		}
 		sendResponse(rw, data, err)
 	case http.MethodPost:
-		value := r.FormValue("value")
-		err := put(key, value)
+		if incr {
+			data, err := increment(store, key, r)
+			sendResponse(rw, data, err)
+			return
+		}
+		if r.Header.Get("If-Match") != "" {
+			putIfMatch(rw, store, key, r)
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			err = putJSON(store, key, r)
+		} else if isOctetStream(r.Header.Get("Content-Type")) {
+			err = putStream(store, key, r)
+		} else {
+			err = put(store, key, r.FormValue("value"), r.FormValue("ttl"))
+		}
 		sendResponse(rw, nil, err)
-	default:
+	case http.MethodDelete:
+		if r.Header.Get("If-Match") != "" {
+			deleteIfMatch(rw, store, key, r)
+			return
+		}
+		sendResponse(rw, nil, store.Delete(key))
+	}
+}
+
+// target finds the bucket and the key of the escaped path after /db/. The key
+// is in the default bucket unless the path has an unescaped slash, so keys
+// with escaped slashes stay there. A missing bucket is created if post is set
+// and is datastore.ErrNotFound otherwise.
+//
+// The bucket is parsed first, and a post to /db/<bucket>/<key>/incr is an
+// increment of the key. A post to /db/<key>/incr increments the key of the
+// default bucket unless a bucket is named like the key; such a path could be
+// either and is rejected.
+//
+// Buckets are not replicated, so a replica rejects their paths instead of
+// finding nothing in them.
+func target(path string, post bool) (store *datastore.Db, key string, incr bool, err error) {
+	store = db
+	if name, rest, ok := strings.Cut(path, "/"); ok {
+		if name, err = url.PathUnescape(name); err != nil {
+			return nil, "", false, err
+		}
+		if post && rest == incrSuffix[1:] {
+			names, err := db.Buckets()
+			if err != nil {
+				return nil, "", false, err
+			}
+			if slices.Contains(names, name) {
+				return nil, "", false, fmt.Errorf("ambiguous path: %s is a bucket, use /db/%s/<key>/incr", name, name)
+			}
+			return db, name, true, nil
+		}
+		if *primary != "" {
+			return nil, "", false, fmt.Errorf("buckets are not replicated, read %s from the primary", name)
+		}
+		if post {
+			store, err = db.CreateBucket(name)
+		} else {
+			store, err = db.Bucket(name)
+		}
+		if err != nil {
+			return nil, "", false, err
+		}
+		path = rest
+		if post && strings.HasSuffix(path, incrSuffix) {
+			path, incr = strings.TrimSuffix(path, incrSuffix), true
+		}
+	}
+	key, err = url.PathUnescape(path)
+	return store, key, incr, err
+}
+
+// handleCompact merges all the segments on demand and responds when it is done.
+func handleCompact(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(rw, "This method is not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := db.Compact(); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	sendResponse(rw, db.Stats().Merges, nil)
 }
 
 func sendResponse(rw http.ResponseWriter, data interface{}, err error) {
-	if err != nil {
+	if errors.Is(err, datastore.ErrVersionMismatch) {
+		http.Error(rw, err.Error(), http.StatusPreconditionFailed)
+	} else if err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 	} else if data != nil {
 		if err := json.NewEncoder(rw).Encode(data); err != nil {
@@ -60,20 +267,120 @@ func sendResponse(rw http.ResponseWriter, data interface{}, err error) {
 	}
 }
 
-func get(key string) (interface{}, error) {
-	value, err := db.Get(key)
+func get(store *datastore.Db, key string) (interface{}, uint64, error) {
+	value, version, err := store.GetWithVersion(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return scanItem{key, value, valueType(value)}, version, nil
+}
+
+// put stores a string value. A non-empty ttl is a duration like "30s" or
+// "1h", after which the value expires.
+func put(store *datastore.Db, key, value, ttl string) error {
+	if value == "" {
+		return fmt.Errorf("can't save empty value")
+	}
+	if ttl == "" {
+		return store.Put(key, value)
+	}
+	duration, err := time.ParseDuration(ttl)
+	if err != nil {
+		return fmt.Errorf("bad ttl: %w", err)
+	}
+	return store.PutWithTTL(key, value, duration)
+}
+
+const incrSuffix = "/incr"
+
+// increment adds the delta from a form field or a {"delta": ...} body to the
+// integer value of the key, the delta is 1 by default.
+func increment(store *datastore.Db, key string, r *http.Request) (interface{}, error) {
+	delta := int64(1)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			Delta *int64 `json:"delta"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		if body.Delta != nil {
+			delta = *body.Delta
+		}
+	} else if value := r.FormValue("delta"); value != "" {
+		var err error
+		delta, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad delta: %w", err)
+		}
+	}
+
+	value, err := store.Increment(key, delta)
 	if err != nil {
 		return nil, err
 	}
 	return struct {
 		Key   string `json:"key"`
-		Value string `json:"value"`
+		Value int64  `json:"value"`
 	}{key, value}, nil
 }
 
-func put(key, value string) error {
-	if value == "" {
-		return fmt.Errorf("can't save empty value")
+// putJSON stores a value from a {"value": ..., "type": ...} body.
+func putJSON(store *datastore.Db, key string, r *http.Request) error {
+	var body jsonValue
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return err
+	}
+	value, err := body.decode()
+	if err != nil {
+		return err
 	}
-	return db.Put(key, value)
-}
\ No newline at end of file
+
+	switch value := value.(type) {
+	case int64:
+		return store.PutInt64(key, value)
+	case []byte:
+		return store.PutBytes(key, value)
+	default:
+		return put(store, key, value.(string), "")
+	}
+}
+
+type jsonValue struct {
+	Value json.RawMessage `json:"value"`
+	Type  string          `json:"type"`
+}
+
+// decode converts the value to a string, int64 or []byte. Without an explicit
+// type, JSON numbers are saved as int64 and strings as strings; "bytes" values
+// are base64-encoded strings.
+func (v jsonValue) decode() (interface{}, error) {
+	if len(v.Value) == 0 {
+		return nil, fmt.Errorf("can't save empty value")
+	}
+
+	valueType := v.Type
+	if valueType == "" {
+		valueType = "string"
+		if v.Value[0] != '"' {
+			valueType = "int64"
+		}
+	}
+
+	switch valueType {
+	case "string":
+		var value string
+		err := json.Unmarshal(v.Value, &value)
+		return value, err
+	case "int64":
+		var value int64
+		err := json.Unmarshal(v.Value, &value)
+		return value, err
+	case "bytes":
+		var value []byte
+		err := json.Unmarshal(v.Value, &value)
+		return value, err
+	default:
+		return nil, fmt.Errorf("unknown value type %q", valueType)
+	}
+}
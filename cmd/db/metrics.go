@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/roman-mazur/architecture-practice-4-template/db/datastore"
+)
+
+// handleMetrics serves the database stats in the Prometheus text format.
+func handleMetrics(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "This method is not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := bufio.NewWriter(rw)
+	writeMetrics(w, db.Stats())
+	w.Flush()
+}
+
+func writeMetrics(w io.Writer, stats datastore.Stats) {
+	m := metricsWriter{w}
+	m.metric("db_segments", "gauge", "Number of segment files.", len(stats.Segments))
+	m.header("db_segment_keys", "gauge", "Keys whose current value is in the segment.")
+	for _, s := range stats.Segments {
+		m.sample("db_segment_keys", segmentLabel(s), s.Keys)
+	}
+	m.header("db_segment_bytes", "gauge", "Size of the segment.")
+	for _, s := range stats.Segments {
+		m.sample("db_segment_bytes", segmentLabel(s), s.Bytes)
+	}
+	m.header("db_segment_live_bytes", "gauge", "Bytes of the segment records holding current values.")
+	for _, s := range stats.Segments {
+		m.sample("db_segment_live_bytes", segmentLabel(s), s.LiveBytes)
+	}
+	m.metric("db_keys", "gauge", "Number of live keys.", stats.Keys)
+	m.metric("db_bytes", "gauge", "Size of all the segments.", stats.Bytes)
+	m.metric("db_live_bytes", "gauge", "Bytes of the records holding current values.", stats.LiveBytes)
+	m.metric("db_dead_bytes", "gauge", "Bytes of overwritten and deleted records, reclaimed by merges.", stats.DeadBytes)
+
+	m.metric("db_merges_total", "counter", "Completed segment merges.", stats.Merges.Count)
+	m.metric("db_merge_failures_total", "counter", "Failed segment merges.", stats.Merges.Failed)
+	m.metric("db_merge_duration_seconds_total", "counter", "Time spent in completed merges.", stats.Merges.TotalSeconds)
+	m.metric("db_last_merge_duration_seconds", "gauge", "Duration of the last completed merge.", stats.Merges.LastSeconds)
+
+	m.histogram("db_get_duration_seconds", "Record lookup latency.", stats.GetLatency)
+	m.histogram("db_put_duration_seconds", "Record write latency.", stats.PutLatency)
+
+	m.metric("db_compression_raw_bytes_total", "counter", "Size of the written values before compression.", stats.Compression.RawBytes)
+	m.metric("db_compression_stored_bytes_total", "counter", "Size of the written values after compression.", stats.Compression.StoredBytes)
+
+	m.metric("db_cache_hits_total", "counter", "Read cache hits.", stats.Cache.Hits)
+	m.metric("db_cache_misses_total", "counter", "Read cache misses.", stats.Cache.Misses)
+	m.metric("db_cache_entries", "gauge", "Entries in the read cache.", stats.Cache.Entries)
+	m.metric("db_cache_bytes", "gauge", "Size of the read cache entries.", stats.Cache.Size)
+}
+
+func segmentLabel(s datastore.SegmentStats) string {
+	return "segment=" + strconv.Quote(s.Name)
+}
+
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m metricsWriter) sample(name, labels string, value interface{}) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(m.w, "%s %v\n", name, value)
+}
+
+func (m metricsWriter) metric(name, kind, help string, value interface{}) {
+	m.header(name, kind, help)
+	m.sample(name, "", value)
+}
+
+func (m metricsWriter) histogram(name, help string, h datastore.Histogram) {
+	m.header(name, "histogram", help)
+	for _, b := range h.Buckets {
+		m.sample(name+"_bucket", "le="+strconv.Quote(strconv.FormatFloat(b.UpperBound, 'g', -1, 64)), b.Count)
+	}
+	m.sample(name+"_bucket", `le="+Inf"`, h.Count)
+	m.sample(name+"_sum", "", h.Sum)
+	m.sample(name+"_count", "", h.Count)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/db/datastore"
+)
+
+// replicationChunk limits the size of the records sent in one response.
+const replicationChunk = 1 << 20
+
+// handleLog sends a follower the records written after the cursor from the
+// query. The cursor to continue from and the primary version are sent in the
+// headers.
+func handleLog(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "This method is not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var (
+		cursor datastore.Cursor
+		err    error
+	)
+	cursor.Segment, err = strconv.Atoi(query.Get("segment"))
+	if err == nil {
+		cursor.Generation, err = strconv.Atoi(query.Get("generation"))
+	}
+	if err == nil {
+		cursor.Offset, err = strconv.ParseInt(query.Get("offset"), 10, 64)
+	}
+	if err == nil {
+		cursor.Version, err = strconv.ParseUint(query.Get("version"), 10, 64)
+	}
+	if err != nil {
+		sendResponse(rw, nil, fmt.Errorf("bad cursor: %w", err))
+		return
+	}
+
+	changes, err := db.Changes(cursor, replicationChunk)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer changes.Close()
+	h := rw.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatInt(changes.Size, 10))
+	h.Set("X-Cursor-Segment", strconv.Itoa(changes.Next.Segment))
+	h.Set("X-Cursor-Generation", strconv.Itoa(changes.Next.Generation))
+	h.Set("X-Cursor-Offset", strconv.FormatInt(changes.Next.Offset, 10))
+	h.Set("X-Cursor-Version", strconv.FormatUint(changes.Next.Version, 10))
+	h.Set("X-Db-Version", strconv.FormatUint(db.Version(), 10))
+	if _, err := io.Copy(rw, changes); err != nil {
+		log.Printf("Can't send the changes: %s", err)
+	}
+}
+
+type replicationStatus struct {
+	Primary        string `json:"primary"`
+	Version        uint64 `json:"version"`
+	PrimaryVersion uint64 `json:"primaryVersion"`
+	// Lag is the number of versions the follower is behind the primary.
+	Lag      uint64    `json:"lag"`
+	LastSync time.Time `json:"lastSync"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// follower applies the records of the primary to the local database.
+type follower struct {
+	primary  string
+	interval time.Duration
+	client   *http.Client
+	cursor   datastore.Cursor
+
+	mu     sync.Mutex
+	status replicationStatus
+}
+
+func newFollower(primary string, interval time.Duration) (*follower, error) {
+	// The records before the saved cursor are already applied.
+	cursor, err := db.ReplicationCursor()
+	if err != nil {
+		return nil, err
+	}
+	return &follower{
+		primary:  primary,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		cursor:   cursor,
+		status:   replicationStatus{Primary: primary},
+	}, nil
+}
+
+// run polls the primary, it waits for the interval when there are no new records.
+func (f *follower) run() {
+	for {
+		caughtUp, err := f.pull()
+
+		f.mu.Lock()
+		lastErr := f.status.Error
+		f.status.Version = db.Version()
+		f.status.Lag = 0
+		if f.status.PrimaryVersion > f.status.Version {
+			f.status.Lag = f.status.PrimaryVersion - f.status.Version
+		}
+		f.status.Error = ""
+		if err != nil {
+			f.status.Error = err.Error()
+		} else {
+			f.status.LastSync = time.Now()
+		}
+		f.mu.Unlock()
+
+		// Log an error once rather than on every retry.
+		if err != nil && err.Error() != lastErr {
+			log.Printf("Replication from %s failed: %s", f.primary, err)
+		}
+		if err != nil || caughtUp {
+			time.Sleep(f.interval)
+		}
+	}
+}
+
+func (f *follower) pull() (bool, error) {
+	query := url.Values{}
+	query.Set("segment", strconv.Itoa(f.cursor.Segment))
+	query.Set("generation", strconv.Itoa(f.cursor.Generation))
+	query.Set("offset", strconv.FormatInt(f.cursor.Offset, 10))
+	query.Set("version", strconv.FormatUint(f.cursor.Version, 10))
+	resp, err := f.client.Get(f.primary + "/db/_log?" + query.Encode())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("primary responded with %s: %s", resp.Status, data)
+	}
+
+	var next datastore.Cursor
+	next.Segment, err = strconv.Atoi(resp.Header.Get("X-Cursor-Segment"))
+	if err == nil {
+		next.Generation, err = strconv.Atoi(resp.Header.Get("X-Cursor-Generation"))
+	}
+	if err == nil {
+		next.Offset, err = strconv.ParseInt(resp.Header.Get("X-Cursor-Offset"), 10, 64)
+	}
+	if err == nil {
+		next.Version, err = strconv.ParseUint(resp.Header.Get("X-Cursor-Version"), 10, 64)
+	}
+	var primaryVersion uint64
+	if err == nil {
+		primaryVersion, err = strconv.ParseUint(resp.Header.Get("X-Db-Version"), 10, 64)
+	}
+	if err != nil {
+		return false, fmt.Errorf("bad cursor from the primary: %w", err)
+	}
+
+	// The records are applied as they arrive, a large value is not held in
+	// memory.
+	if err := db.ApplyChanges(resp.Body); err != nil {
+		return false, err
+	}
+	if next != f.cursor {
+		if err := db.SaveReplicationCursor(next); err != nil {
+			return false, err
+		}
+	}
+	f.cursor = next
+	f.mu.Lock()
+	f.status.PrimaryVersion = primaryVersion
+	f.mu.Unlock()
+	return resp.ContentLength == 0, nil
+}
+
+func (f *follower) handleStatus(rw http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	status := f.status
+	f.mu.Unlock()
+	sendResponse(rw, status, nil)
+}
+
+// readOnly rejects the writes on a follower, they have to go to the primary,
+// and on a db opened with -read-only.
+func readOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "This method is not allowed on a read-only db", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(rw, r)
+	}
+}
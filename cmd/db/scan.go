@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/roman-mazur/architecture-practice-4-template/db/datastore"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+type scanItem struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	// Type is the value type accepted by a JSON put: string, int64 or bytes.
+	Type string `json:"type"`
+}
+
+type scanPage struct {
+	Items []scanItem `json:"items"`
+	// Cursor is set when there are more keys, pass it to get the next page.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// scan lists the keys with the prefix in ascending order, starting after the cursor.
+func scan(store *datastore.Db, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	cursor := query.Get("cursor")
+
+	limit := defaultScanLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxScanLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxScanLimit)
+		}
+	}
+
+	it := store.ScanPrefix(prefix)
+	if cursor != "" {
+		// Continue from the smallest key after the cursor.
+		it.Seek(cursor + "\x00")
+	}
+
+	page := scanPage{Items: []scanItem{}}
+	for it.Next() {
+		if len(page.Items) == limit {
+			page.Cursor = page.Items[limit-1].Key
+			break
+		}
+		value := it.TypedValue()
+		page.Items = append(page.Items, scanItem{it.Key(), value, valueType(value)})
+	}
+	return page, it.Err()
+}
+
+func valueType(value interface{}) string {
+	switch value.(type) {
+	case int64:
+		return "int64"
+	case []byte:
+		return "bytes"
+	default:
+		return "string"
+	}
+}
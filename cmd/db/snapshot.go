@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// handleSnapshot streams a tar archive of a database snapshot. Unpacked, it is
+// a data directory for the -dir flag.
+func handleSnapshot(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "This method is not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Next to the data directory, so segments are hard-linked rather than copied.
+	snapshotDir, err := os.MkdirTemp(filepath.Dir(filepath.Clean(*dir)), "snapshot-")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(snapshotDir)
+
+	if err := db.Snapshot(snapshotDir); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/x-tar")
+	rw.Header().Set("Content-Disposition", `attachment; filename="snapshot.tar"`)
+	if err := writeTar(rw, snapshotDir); err != nil {
+		// The status is already sent, break the connection so the client
+		// does not take the archive for a complete one.
+		log.Printf("Can't send the snapshot: %s", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeTar archives the files and the directories under dir, like the buckets
+// of the snapshot, with the names relative to it.
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if entry.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/roman-mazur/architecture-practice-4-template/db/datastore"
+)
+
+const octetStream = "application/octet-stream"
+
+// isOctetStream reports whether the media type of the header value, like
+// Content-Type or Accept, is a raw octet stream.
+func isOctetStream(value string) bool {
+	for _, part := range strings.Split(value, ",") {
+		mediaType, _, err := mime.ParseMediaType(part)
+		if err == nil && mediaType == octetStream {
+			return true
+		}
+	}
+	return false
+}
+
+// putStream saves the request body as a bytes value without reading it into memory.
+func putStream(store *datastore.Db, key string, r *http.Request) error {
+	return store.PutReader(key, r.Body, r.ContentLength)
+}
+
+// getStream sends the raw string or bytes value.
+func getStream(rw http.ResponseWriter, store *datastore.Db, key string) {
+	value, err := store.GetReader(key)
+	if err != nil {
+		sendResponse(rw, nil, err)
+		return
+	}
+	defer value.Close()
+
+	rw.Header().Set("Content-Type", octetStream)
+	if _, err := io.Copy(rw, value); err != nil {
+		// The status is already sent, break the connection so the client
+		// does not take the value for a complete one.
+		log.Printf("Can't send the value of %s: %s", key, err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/roman-mazur/architecture-practice-4-template/db/datastore"
+)
+
+// etag formats the record version as a strong entity tag.
+func etag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+// parseETag reads the version from an If-Match header with a single entity tag.
+func parseETag(header string) (uint64, error) {
+	tag, err := strconv.Unquote(strings.TrimSpace(header))
+	if err == nil {
+		version, err := strconv.ParseUint(tag, 10, 64)
+		if err == nil {
+			return version, nil
+		}
+	}
+	return 0, fmt.Errorf("bad If-Match header %q", header)
+}
+
+// putIfMatch stores a string value only if the key still has the version from
+// the If-Match header, the new version is sent back as the ETag.
+func putIfMatch(rw http.ResponseWriter, store *datastore.Db, key string, r *http.Request) {
+	version, err := parseETag(r.Header.Get("If-Match"))
+	if err != nil {
+		sendResponse(rw, nil, err)
+		return
+	}
+	value, err := conditionalValue(r)
+	if err != nil {
+		sendResponse(rw, nil, err)
+		return
+	}
+
+	newVersion, err := store.CompareAndSwap(key, version, value)
+	if err == nil {
+		rw.Header().Set("ETag", etag(newVersion))
+	}
+	sendResponse(rw, nil, err)
+}
+
+// conditionalValue reads the value of a conditional put, which can only be a string without a ttl.
+func conditionalValue(r *http.Request) (string, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body jsonValue
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return "", err
+		}
+		value, err := body.decode()
+		if err != nil {
+			return "", err
+		}
+		if s, ok := value.(string); ok && s != "" {
+			return s, nil
+		}
+		return "", fmt.Errorf("only non-empty string values can be saved with If-Match")
+	}
+
+	if r.FormValue("ttl") != "" {
+		return "", fmt.Errorf("ttl can't be used with If-Match")
+	}
+	value := r.FormValue("value")
+	if value == "" {
+		return "", fmt.Errorf("can't save empty value")
+	}
+	return value, nil
+}
+
+func deleteIfMatch(rw http.ResponseWriter, store *datastore.Db, key string, r *http.Request) {
+	version, err := parseETag(r.Header.Get("If-Match"))
+	if err != nil {
+		sendResponse(rw, nil, err)
+		return
+	}
+	sendResponse(rw, nil, store.CompareAndDelete(key, version))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/db/cluster"
+	"github.com/roman-mazur/architecture-practice-4-template/httptools"
+	"github.com/roman-mazur/architecture-practice-4-template/signal"
+)
+
+var (
+	port     = flag.Int("port", 8100, "router port")
+	nodes    = flag.String("nodes", "", "comma-separated host:port addresses of the db nodes")
+	replicas = flag.Int("replicas", cluster.DefaultReplicas, "points of every node on the hash ring")
+	timeout  = flag.Duration("timeout", 10*time.Second, "db node request timeout")
+)
+
+// The router sends /db/<key> requests to the db node owning the key. Run with
+//
+//	dbrouter -nodes=db1:8100,db2:8100 rebalance -from=db1:8100
+//
+// to move the keys after the nodes change, -from lists the previous nodes.
+func main() {
+	flag.Parse()
+	ring, err := cluster.NewRing(splitNodes(*nodes), *replicas)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "rebalance" {
+		rebalance(ring, flag.Args()[1:])
+		return
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	server := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		route(client, ring, rw, r)
+	}))
+	log.Printf("Routing to %s", strings.Join(ring.Nodes(), ", "))
+	server.Start()
+	signal.WaitForTerminationSignal()
+}
+
+func rebalance(ring *cluster.Ring, args []string) {
+	fs := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	from := fs.String("from", "", "comma-separated host:port addresses of the db nodes before the change")
+	fs.Parse(args)
+	if *from == "" {
+		fmt.Fprintln(os.Stderr, "-from is required")
+		os.Exit(2)
+	}
+
+	moved, err := cluster.Rebalance(ring, splitNodes(*from), &http.Client{Timeout: *timeout})
+	log.Printf("Moved %d keys", moved)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func splitNodes(list string) []string {
+	var res []string
+	for _, node := range strings.Split(list, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
+// route forwards a key request to its node. Requests without a key, like
+// scans and batches, span several nodes and are not supported. Neither are
+// the buckets, their keys are not moved by a rebalance.
+func route(client *http.Client, ring *cluster.Ring, rw http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	escaped := strings.TrimSuffix(strings.TrimPrefix(path, "/db/"), "/incr")
+	key, err := url.PathUnescape(escaped)
+	if !strings.HasPrefix(path, "/db/") || err != nil || key == "" || strings.HasPrefix(key, "_") {
+		http.Error(rw, "The request is not supported by the router", http.StatusNotImplemented)
+		return
+	}
+	// An unescaped slash separates the bucket from the key.
+	if strings.Contains(escaped, "/") {
+		http.Error(rw, "Buckets are not supported by the router", http.StatusNotImplemented)
+		return
+	}
+
+	dst := ring.Node(key)
+	fwdRequest := r.Clone(r.Context())
+	fwdRequest.RequestURI = ""
+	fwdRequest.URL.Host = dst
+	fwdRequest.URL.Scheme = "http"
+	fwdRequest.Host = dst
+	resp, err := client.Do(fwdRequest)
+	if err != nil {
+		log.Printf("Failed to get response from %s: %s", dst, err)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	rw.Header().Set("X-Db-Node", dst)
+	rw.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(rw, resp.Body); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/db/datastore"
+)
+
+const usage = `dbtool inspects the data directory of a db which is not running.
+
+Usage:
+
+	dbtool <command> [-dir=./out] [-segment-prefix=segment-data-] [segment...]
+
+Commands:
+
+	ls       list the segments with their sizes and record counts
+	dump     print every record with its offset and checksum status
+	verify   check the checksums of all records, exits with 1 on problems
+	repair   rewrite the segments without the damaged records
+	compact  merge all the segments into one
+
+repair and compact refuse to change a data directory locked by a running db.
+`
+
+// Commands taking segments work with all of them when none are given.
+var commands = map[string]func(dir, prefix string, segments []string) error{
+	"ls":      list,
+	"dump":    dump,
+	"verify":  verify,
+	"repair":  repair,
+	"compact": compact,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	dir := fs.String("dir", "./out", "data directory")
+	prefix := fs.String("segment-prefix", datastore.DefaultOptions().SegmentPrefix, "segment file name prefix")
+	fs.Parse(os.Args[2:])
+
+	if err := commands[os.Args[1]](*dir, *prefix, fs.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// segmentPaths returns the paths of the named segments, or of all the
+// segments in the directory.
+func segmentPaths(dir, prefix string, names []string) ([]string, error) {
+	if len(names) == 0 {
+		segments, _, err := datastore.ListSegments(dir, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range segments {
+			names = append(names, s.Name)
+		}
+	}
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, filepath.Join(dir, filepath.Base(name)))
+	}
+	return paths, nil
+}
+
+func list(dir, prefix string, _ []string) error {
+	segments, other, err := datastore.ListSegments(dir, prefix)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-24s %12s %9s %8s  %s\n", "SEGMENT", "SIZE", "RECORDS", "INVALID", "HINT")
+	for _, s := range segments {
+		var records, invalid int
+		var tailErr error
+		err := datastore.ScanSegment(filepath.Join(dir, s.Name), func(rec datastore.SegmentRecord) error {
+			switch {
+			case rec.Err != nil:
+				tailErr = rec.Err
+			case rec.InBatch:
+			case !rec.Valid:
+				invalid++
+				records++
+			default:
+				records++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		hint := "-"
+		if s.HasHint {
+			hint = "ok"
+			if s.HintErr != nil {
+				hint = s.HintErr.Error()
+			}
+		}
+		fmt.Printf("%-24s %12d %9d %8d  %s\n", s.Name, s.Size, records, invalid, hint)
+		if tailErr != nil {
+			fmt.Printf("  bad tail: %s\n", tailErr)
+		}
+	}
+	for _, name := range other {
+		fmt.Printf("%-24s unexpected file, the db won't open\n", name)
+	}
+	return nil
+}
+
+func dump(dir, prefix string, names []string) error {
+	paths, err := segmentPaths(dir, prefix, names)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		fmt.Printf("# %s\n", filepath.Base(path))
+		err := datastore.ScanSegment(path, func(rec datastore.SegmentRecord) error {
+			fmt.Println(formatRecord(rec))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatRecord(rec datastore.SegmentRecord) string {
+	if rec.Err != nil {
+		return fmt.Sprintf("%10d  BAD %d bytes: %s", rec.Offset, rec.Size, rec.Err)
+	}
+
+	status := "ok "
+	if !rec.Valid {
+		status = "BAD"
+	}
+	indent := ""
+	if rec.InBatch {
+		indent = "  "
+	}
+	line := fmt.Sprintf("%10d  %s %s%s v%d", rec.Offset, status, indent, strconv.Quote(rec.Key), rec.Version)
+	switch {
+	case rec.Batch:
+		line += " batch"
+	case rec.Tombstone:
+		line += " deleted"
+	default:
+		line += fmt.Sprintf(" %s=%s", rec.Type, strconv.Quote(rec.Value))
+	}
+	if rec.Compressed {
+		line += " gzip"
+	}
+	if rec.Legacy {
+		line += " sha1"
+	}
+	if !rec.ExpiresAt.IsZero() {
+		line += " expires=" + rec.ExpiresAt.Format(time.RFC3339)
+	}
+	return line
+}
+
+func verify(dir, prefix string, names []string) error {
+	paths, err := segmentPaths(dir, prefix, names)
+	if err != nil {
+		return err
+	}
+	problems := 0
+	for _, path := range paths {
+		err := datastore.ScanSegment(path, func(rec datastore.SegmentRecord) error {
+			if rec.Err != nil || !rec.Valid {
+				problems++
+				fmt.Printf("%s: %s\n", filepath.Base(path), formatRecord(rec))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("found %d damaged records, run dbtool repair", problems)
+	}
+	fmt.Printf("%d segments are ok\n", len(paths))
+	return nil
+}
+
+func repair(dir, prefix string, names []string) error {
+	paths, err := segmentPaths(dir, prefix, names)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		stats, err := datastore.RepairSegment(path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: kept %d records, skipped %d, truncated %d bytes\n",
+			filepath.Base(path), stats.Kept, stats.Skipped, stats.Truncated)
+	}
+	return nil
+}
+
+func compact(dir, prefix string, names []string) error {
+	if len(names) > 0 {
+		return errors.New("compact merges all the segments, don't name them")
+	}
+	opts := datastore.DefaultOptions()
+	opts.SegmentPrefix = prefix
+	if err := datastore.Compact(dir, opts); err != nil {
+		return err
+	}
+	return list(dir, prefix, nil)
+}
@@ -8,19 +8,24 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/roman-mazur/architecture-practice-4-template/db/cluster"
 	"github.com/roman-mazur/architecture-practice-4-template/httptools"
 	"github.com/roman-mazur/architecture-practice-4-template/signal"
 )
 
 var port = flag.Int("port", 8080, "server port")
 var dbUrl = flag.String("db-url", "db:8100", "db url")
+var dbNodes = flag.String("db-nodes", "", "comma-separated db node addresses to shard the keys between, overrides db-url")
 var delay = flag.Duration("delay", 0, "response delay")
 
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
 func main() {
+	flag.Parse()
+	connectCluster()
 	h := new(http.ServeMux)
 	createTeam()
 
@@ -44,8 +49,8 @@ func main() {
 		
 		fwdRequest := r.Clone(ctx)
 		fwdRequest.RequestURI = ""
-		fwdRequest.URL.Host = *dbUrl
-		fwdRequest.Host = *dbUrl
+		fwdRequest.URL.Host = dbHost(key)
+		fwdRequest.Host = fwdRequest.URL.Host
 		fwdRequest.URL.Scheme = "http"
 		fwdRequest.URL.Path = "/db/" + key
 
@@ -86,8 +91,29 @@ func createTeam() {
 	formData := url.Values{}
 	formData.Set("value", time.Now().Format("2006-01-02"))
 
-	resp, err := http.PostForm("http" + "://" + *dbUrl + "/db/" + "gods", formData)
+	resp, err := http.PostForm("http" + "://" + dbHost("gods") + "/db/" + "gods", formData)
 	if err != nil || resp.StatusCode != http.StatusOK {
 		panic("Error occured when initializing DB")
 	}
 }
+
+var dbCluster *cluster.Client
+
+// dbHost returns the db node owning the key.
+func dbHost(key string) string {
+	if dbCluster == nil {
+		return *dbUrl
+	}
+	return dbCluster.Node(key)
+}
+
+func connectCluster() {
+	if *dbNodes == "" {
+		return
+	}
+	ring, err := cluster.NewRing(strings.Split(*dbNodes, ","), cluster.DefaultReplicas)
+	if err != nil {
+		panic(err)
+	}
+	dbCluster = cluster.NewClient(ring, nil)
+}
@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/roman-mazur/architecture-practice-4-template/db/datastore"
+)
+
+// Client sends the requests for a key to the db node owning it.
+type Client struct {
+	ring *Ring
+	http *http.Client
+}
+
+// NewClient uses http.DefaultClient if httpClient is nil.
+func NewClient(ring *Ring, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{ring, httpClient}
+}
+
+// Node returns the address of the node owning the key.
+func (c *Client) Node(key string) string {
+	return c.ring.Node(key)
+}
+
+// URL returns the address of the key on its node.
+func (c *Client) URL(key string) string {
+	return keyURL(c.ring.Node(key), key)
+}
+
+// Get returns the value of the key as a string, an int64 or []byte. Missing
+// keys return datastore.ErrNotFound.
+func (c *Client) Get(key string) (interface{}, error) {
+	return getValue(c.http, c.ring.Node(key), key)
+}
+
+func (c *Client) Put(key, value string) error {
+	resp, err := c.http.PostForm(c.URL(key), url.Values{"value": {value}})
+	if err != nil {
+		return err
+	}
+	return responseError(resp)
+}
+
+func (c *Client) Delete(key string) error {
+	return deleteKey(c.http, c.ring.Node(key), key)
+}
+
+func keyURL(node, key string) string {
+	return "http://" + node + "/db/" + url.PathEscape(key)
+}
+
+// typedValue is the JSON value of a key with its type, as it is read by a scan
+// and written by a JSON put.
+type typedValue struct {
+	Value json.RawMessage `json:"value"`
+	Type  string          `json:"type,omitempty"`
+}
+
+func (v typedValue) decode() (interface{}, error) {
+	switch v.Type {
+	case "int64":
+		var value int64
+		err := json.Unmarshal(v.Value, &value)
+		return value, err
+	case "bytes":
+		var value []byte
+		err := json.Unmarshal(v.Value, &value)
+		return value, err
+	default:
+		var value string
+		err := json.Unmarshal(v.Value, &value)
+		return value, err
+	}
+}
+
+func getValue(client *http.Client, node, key string) (interface{}, error) {
+	resp, err := client.Get(keyURL(node, key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var body typedValue
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.decode()
+}
+
+func deleteKey(client *http.Client, node, key string) error {
+	req, err := http.NewRequest(http.MethodDelete, keyURL(node, key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return responseError(resp)
+}
+
+func putTyped(client *http.Client, node, key string, value typedValue) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(keyURL(node, key), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return responseError(resp)
+}
+
+// responseError closes the response and converts a failed one to an error.
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	message, _ := io.ReadAll(resp.Body)
+	text := strings.TrimSpace(string(message))
+	if text == datastore.ErrNotFound.Error() {
+		return datastore.ErrNotFound
+	}
+	return fmt.Errorf("db responded with %s: %s", resp.Status, text)
+}
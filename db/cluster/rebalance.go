@@ -0,0 +1,97 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/roman-mazur/architecture-practice-4-template/db/datastore"
+)
+
+// rebalancePage is the number of keys read from a node at once.
+const rebalancePage = 1000
+
+type scanPage struct {
+	Items []struct {
+		Key string `json:"key"`
+		typedValue
+	} `json:"items"`
+	Cursor string `json:"cursor"`
+}
+
+// Rebalance moves the keys stored on the nodes to their owners in the ring.
+// The nodes are the members before the change, including the ones leaving
+// the cluster. It returns the number of moved keys.
+//
+// A key is copied only if the new owner does not have it yet, since a value
+// written there through the new ring is newer. Moved keys lose their TTL and
+// get new versions. Only the default keyspace is moved, the router rejects
+// the bucket paths.
+func Rebalance(ring *Ring, nodes []string, httpClient *http.Client) (int, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	moved := 0
+	for _, node := range nodes {
+		cursor := ""
+		for {
+			page, err := scanNode(httpClient, node, cursor)
+			if err != nil {
+				return moved, fmt.Errorf("can't scan %s: %w", node, err)
+			}
+			for _, item := range page.Items {
+				owner := ring.Node(item.Key)
+				if owner == node {
+					continue
+				}
+				if err := moveKey(httpClient, node, owner, item.Key, item.typedValue); err != nil {
+					return moved, fmt.Errorf("can't move %s from %s to %s: %w", item.Key, node, owner, err)
+				}
+				moved++
+			}
+			if page.Cursor == "" {
+				break
+			}
+			cursor = page.Cursor
+		}
+	}
+	return moved, nil
+}
+
+func scanNode(client *http.Client, node, cursor string) (scanPage, error) {
+	var page scanPage
+	query := url.Values{}
+	query.Set("limit", fmt.Sprint(rebalancePage))
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	resp, err := client.Get("http://" + node + "/db/?" + query.Encode())
+	if err != nil {
+		return page, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return page, responseError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	return page, err
+}
+
+func moveKey(client *http.Client, from, to, key string, value typedValue) error {
+	_, err := getValue(client, to, key)
+	if err == datastore.ErrNotFound {
+		err = putTyped(client, to, key, value)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = deleteKey(client, from, key)
+	if err == datastore.ErrNotFound {
+		// Deleted meanwhile.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeNode serves the part of the cmd/db API used by the cluster package.
+type fakeNode struct {
+	mu     sync.Mutex
+	values map[string]typedValue
+}
+
+func (n *fakeNode) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	value, ok := n.values[key]
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		n.scan(rw, r)
+	case r.Method == http.MethodGet && ok:
+		json.NewEncoder(rw).Encode(struct {
+			Key string `json:"key"`
+			typedValue
+		}{key, value})
+	case r.Method == http.MethodPost:
+		if r.Header.Get("Content-Type") == "application/json" {
+			json.NewDecoder(r.Body).Decode(&value)
+		} else {
+			value = typedValue{Value: json.RawMessage(strconv.Quote(r.FormValue("value"))), Type: "string"}
+		}
+		n.values[key] = value
+	case r.Method == http.MethodDelete && ok:
+		delete(n.values, key)
+	default:
+		http.Error(rw, "record does not exist", http.StatusBadRequest)
+	}
+}
+
+func (n *fakeNode) scan(rw http.ResponseWriter, r *http.Request) {
+	var keys []string
+	for key := range n.values {
+		if key > r.URL.Query().Get("cursor") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var page scanPage
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if len(keys) > limit {
+		keys = keys[:limit]
+		page.Cursor = keys[limit-1]
+	}
+	for _, key := range keys {
+		page.Items = append(page.Items, struct {
+			Key string `json:"key"`
+			typedValue
+		}{key, n.values[key]})
+	}
+	json.NewEncoder(rw).Encode(page)
+}
+
+func TestRebalance(t *testing.T) {
+	var addresses []string
+	nodes := make(map[string]*fakeNode)
+	for i := 0; i < 3; i++ {
+		node := &fakeNode{values: make(map[string]typedValue)}
+		server := httptest.NewServer(node)
+		defer server.Close()
+		address := strings.TrimPrefix(server.URL, "http://")
+		addresses = append(addresses, address)
+		nodes[address] = node
+	}
+
+	before, err := NewRing(addresses[:2], DefaultReplicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(before, nil)
+	for i := 0; i < 2500; i++ {
+		if err := client.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodes[before.Node("typed")].values["typed"] = typedValue{json.RawMessage("42"), "int64"}
+
+	t.Run("node joins", func(t *testing.T) {
+		after, err := NewRing(addresses, DefaultReplicas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A newer value written through the new ring is kept.
+		newer := NewClient(after, nil)
+		if after.Node("key0") != before.Node("key0") {
+			newer.Put("key0", "newer")
+		}
+		moved, err := Rebalance(after, before.Nodes(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved == 0 || len(nodes[addresses[2]].values) != moved {
+			t.Errorf("ERROR! Moved %d keys, the new node has %d", moved, len(nodes[addresses[2]].values))
+		}
+
+		for address, node := range nodes {
+			for key := range node.values {
+				if after.Node(key) != address {
+					t.Errorf("ERROR! %s is left on %s", key, address)
+				}
+			}
+		}
+		for i := 1; i < 2500; i++ {
+			key := "key" + strconv.Itoa(i)
+			value, err := newer.Get(key)
+			if err != nil || value != "value"+strconv.Itoa(i) {
+				t.Fatalf("ERROR! %s\nExpected: value%d;\nGot: %v (%v)", key, i, value, err)
+			}
+		}
+		if value, _ := newer.Get("typed"); value != int64(42) {
+			t.Errorf("ERROR!\nExpected: 42;\nGot: %v", value)
+		}
+		if after.Node("key0") != before.Node("key0") {
+			if value, _ := newer.Get("key0"); value != "newer" {
+				t.Errorf("ERROR!\nExpected: newer;\nGot: %v", value)
+			}
+		}
+	})
+
+	t.Run("node leaves", func(t *testing.T) {
+		after, err := NewRing(addresses[1:], DefaultReplicas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Rebalance(after, addresses, nil); err != nil {
+			t.Fatal(err)
+		}
+		if left := len(nodes[addresses[0]].values); left != 0 {
+			t.Errorf("ERROR! %d keys are left on the removed node", left)
+		}
+		total := 0
+		for _, node := range nodes {
+			total += len(node.values)
+		}
+		if total != 2501 {
+			t.Errorf("ERROR! The cluster has %d keys instead of 2501", total)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+// Package cluster splits the keyspace between db nodes with a consistent-hash
+// ring, so adding or removing a node moves only the keys of its ranges.
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of points every node gets on the ring, more
+// points make the ranges of the nodes closer in size.
+const DefaultReplicas = 100
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// Ring maps keys to the nodes owning them. It is not changed after creation,
+// so it can be shared between goroutines.
+type Ring struct {
+	nodes  []string
+	points []point
+}
+
+// NewRing places the nodes, given as host:port addresses, on the ring.
+func NewRing(nodes []string, replicas int) (*Ring, error) {
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes in the ring")
+	}
+	if replicas <= 0 {
+		return nil, fmt.Errorf("replicas must be positive, got %d", replicas)
+	}
+
+	r := &Ring{}
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		if seen[node] {
+			return nil, fmt.Errorf("node %s is listed twice", node)
+		}
+		seen[node] = true
+		r.nodes = append(r.nodes, node)
+		for i := 0; i < replicas; i++ {
+			r.points = append(r.points, point{hash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r, nil
+}
+
+// Node returns the node owning the key: the first one clockwise from the key hash.
+func (r *Ring) Node(key string) string {
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Nodes returns the nodes in the order they were given.
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+func hash(s string) uint64 {
+	h := sha256.Sum256([]byte(s))
+	return binary.LittleEndian.Uint64(h[:8])
+}
@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	ring, err := NewRing([]string{"db1:8100", "db2:8100", "db3:8100"}, DefaultReplicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("distribution", func(t *testing.T) {
+		counts := make(map[string]int)
+		for i := 0; i < 3000; i++ {
+			counts[ring.Node("key"+strconv.Itoa(i))]++
+		}
+		for _, node := range ring.Nodes() {
+			if counts[node] < 600 || counts[node] > 1400 {
+				t.Errorf("ERROR! Node %s owns %d keys of 3000", node, counts[node])
+			}
+		}
+	})
+
+	t.Run("adding a node", func(t *testing.T) {
+		bigger, err := NewRing([]string{"db1:8100", "db2:8100", "db3:8100", "db4:8100"}, DefaultReplicas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		moved := 0
+		for i := 0; i < 3000; i++ {
+			key := "key" + strconv.Itoa(i)
+			before, after := ring.Node(key), bigger.Node(key)
+			if before != after {
+				moved++
+				if after != "db4:8100" {
+					t.Fatalf("ERROR! %s moved from %s to %s", key, before, after)
+				}
+			}
+		}
+		if moved < 450 || moved > 1050 {
+			t.Errorf("ERROR! %d keys of 3000 moved to the new node", moved)
+		}
+	})
+
+	t.Run("bad rings", func(t *testing.T) {
+		if _, err := NewRing(nil, DefaultReplicas); err == nil {
+			t.Error("ERROR! Expected an error for an empty ring")
+		}
+		if _, err := NewRing([]string{"db1:8100", "db1:8100"}, DefaultReplicas); err == nil {
+			t.Error("ERROR! Expected an error for a duplicated node")
+		}
+	})
+}
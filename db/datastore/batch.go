@@ -0,0 +1,107 @@
+package datastore
+
+// WriteBatch collects puts and deletes that are written by Db.Batch as a single
+// record, so after a crash either all of them are visible or none.
+type WriteBatch struct {
+	entries []Entry
+}
+
+func (wb *WriteBatch) Put(key, value string) {
+	wb.entries = append(wb.entries, newValueEntry(key, value, typeString))
+}
+
+func (wb *WriteBatch) PutInt64(key string, value int64) {
+	wb.entries = append(wb.entries, newValueEntry(key, encodeInt64(value), typeInt64))
+}
+
+func (wb *WriteBatch) PutBytes(key string, value []byte) {
+	wb.entries = append(wb.entries, newValueEntry(key, string(value), typeBytes))
+}
+
+// Delete adds a tombstone for the key. Unlike Db.Delete, it does not fail for missing keys.
+func (wb *WriteBatch) Delete(key string) {
+	wb.entries = append(wb.entries, newTombstone(key))
+}
+
+func (wb *WriteBatch) Len() int {
+	return len(wb.entries)
+}
+
+// Batch atomically writes all the batch entries. Later entries for the same key win.
+func (db *Db) Batch(wb *WriteBatch) error {
+	if wb.Len() == 0 {
+		return nil
+	}
+	// Compress a copy, so the batch can be written again.
+	entries := append([]Entry(nil), wb.entries...)
+	for i := range entries {
+		db.compress(&entries[i])
+	}
+	return db.append(newBatchEntry(entries))
+}
+
+// newBatchEntry frames the entries as the value of a single record, so they
+// share its checksum.
+func newBatchEntry(entries []Entry) Entry {
+	var value []byte
+	for i := range entries {
+		value = append(value, entries[i].Encode()...)
+	}
+	return Entry{
+		value: string(value),
+		flags: flagBatch,
+	}
+}
+
+// setVersion assigns the version to the entry and, for a batch, to all the
+// entries inside it.
+func (e *Entry) setVersion(version uint64) error {
+	e.version = version
+	if !e.isBatch() {
+		return nil
+	}
+
+	var entries []Entry
+	err := e.batchEntries(func(inner *Entry, _, _ int64) {
+		inner.version = version
+		entries = append(entries, *inner)
+	})
+	if err != nil {
+		return err
+	}
+	*e = newBatchEntry(entries)
+	e.version = version
+	return nil
+}
+
+func (e *Entry) isBatch() bool {
+	return e.flags&flagBatch != 0
+}
+
+// batchEntries decodes the framed entries and calls fn for each of them with
+// its offset relative to the beginning of the batch record and its size.
+func (e *Entry) batchEntries(fn func(inner *Entry, offset, size int64)) error {
+	data := []byte(e.value)
+	valueOffset := int64(12 + len(e.key))
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 4 {
+			return errCorrupted
+		}
+		size, ok := recordSize(data[pos:])
+		if !ok || size > int64(len(data)-pos) {
+			return errCorrupted
+		}
+
+		var inner Entry
+		err := inner.Decode(data[pos : pos+int(size)])
+		if err != nil {
+			return err
+		}
+		if inner.isBatch() {
+			return errCorrupted
+		}
+		fn(&inner, valueOffset+int64(pos), size)
+		pos += int(size)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package datastore
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDb_Batch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("stale", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	wb := new(WriteBatch)
+	wb.Put("team", "gods")
+	wb.Put("date", "2024-05-01")
+	wb.PutInt64("members", 3)
+	wb.Put("date", "2024-05-02")
+	wb.Delete("stale")
+	if err := db.Batch(wb); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, db *Db) {
+		for key, expected := range map[string]string{"team": "gods", "date": "2024-05-02", "members": "3"} {
+			value, err := db.Get(key)
+			if err != nil || value != expected {
+				t.Errorf("ERROR! %s\nExpected: %s;\nGot: %s (%v)", key, expected, value, err)
+			}
+		}
+		if _, err := db.Get("stale"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	}
+
+	t.Run("same process", func(t *testing.T) {
+		check(t, db)
+	})
+
+	t.Run("new DB process", func(t *testing.T) {
+		db.Close()
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		db.segmentSize = 0
+		for _, key := range []string{"filler1", "filler2", "filler3"} {
+			if err := db.Put(key, "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+	})
+
+	t.Run("torn batch", func(t *testing.T) {
+		wb := new(WriteBatch)
+		wb.Put("team", "torn")
+		wb.Put("extra", "torn")
+		if err := db.Batch(wb); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		last := db.blocks[len(db.blocks)-1]
+		if err := os.Truncate(last.outPath, last.written()-1); err != nil {
+			t.Fatal(err)
+		}
+
+		db.Close()
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		check(t, db)
+		if _, err := db.Get("extra"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	})
+}
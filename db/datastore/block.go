@@ -2,32 +2,60 @@ package datastore
 
 import (
 	"bufio"
-	"context"
 	"crypto/sha1"
-	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var ErrNotFound = fmt.Errorf("record does not exist")
 
-type hashIndex map[string]int64
+// errDeleted is returned by block.get when the newest record for a key in the block is a tombstone.
+var errDeleted = fmt.Errorf("record was deleted")
+
+// location is the offset and the size of a record in the segment.
+type location struct {
+	offset, size int64
+}
+
+type hashIndex map[string]location
 
 type block struct {
 	index     hashIndex
+	deleted   map[string]struct{}
 	segment   *os.File
 	outPath   string
 	outOffset int64
+	dropped   int64 // size of the torn tail removed by recover
+	hinted    bool  // whether recover loaded the index from the hint file
+	// readOnly blocks have no segment file and no writer, a torn tail is
+	// left in the segment.
+	readOnly bool
+	// maxVersion is the highest version of the records in the segment.
+	maxVersion uint64
+	// versions is the counter of the database used to stamp the written
+	// entries. It is nil for merged blocks, whose entries keep their versions
+	// like the replicated ones do.
+	versions *atomic.Uint64
+	// unsynced is set when records are acknowledged without an fsync.
+	unsynced  atomic.Bool
 	rwmu      sync.RWMutex
-	writeCh chan writeArgument
-	cancel    context.CancelFunc
+	writeCh   chan writeArgument
+	writeDone chan struct{}
+
+	// reader is shared by all lookups, it is opened on the first one.
+	reader   atomic.Pointer[os.File]
+	readerMu sync.Mutex
 }
 
-func newBlock(dir, outFileName string) (*block, error) {
+// newBlock opens the segment for appends. The active segment is the last one,
+// only it can end with a torn record.
+func newBlock(dir, outFileName string, durability Durability, versions *atomic.Uint64, active bool) (*block, error) {
 	outputPath := filepath.Join(dir, outFileName)
 	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
@@ -35,141 +63,328 @@ func newBlock(dir, outFileName string) (*block, error) {
 	}
 
 	bl := &block{
-		index:    make(hashIndex),
-		segment:  f,
-		outPath: outputPath,
-		writeCh: make(chan writeArgument),
+		index:     make(hashIndex),
+		deleted:   make(map[string]struct{}),
+		segment:   f,
+		outPath:   outputPath,
+		versions:  versions,
+		writeCh:   make(chan writeArgument),
+		writeDone: make(chan struct{}),
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	bl.cancel = cancel
-	go bl.write(ctx)
-
-	err = bl.recover()
-	if err != nil && err != io.EOF {
+	err = bl.recover(active)
+	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
+	go bl.write(durability)
 	return bl, nil
 }
 
+// openReadOnlyBlock indexes the segment without opening it for writing.
+func openReadOnlyBlock(dir, fileName string, active bool) (*block, error) {
+	bl := &block{
+		index:    make(hashIndex),
+		deleted:  make(map[string]struct{}),
+		outPath:  filepath.Join(dir, fileName),
+		readOnly: true,
+	}
+	return bl, bl.recover(active)
+}
+
 const bufSize = 8192
 
-func (b *block) recover() error {
+// recover rebuilds the index from the segment. A record of the active segment
+// that is cut short or fails its checksum at the end of the file is left by a
+// write interrupted by a crash, so the segment is truncated back to the end of
+// the last valid record. So is a header with an impossible size followed only
+// by zeros, which is left when the file grew but the data was not written.
+// Any other bad record is damage that recovery must not throw away with the
+// records after it, it fails with errCorrupted.
+func (b *block) recover(active bool) error {
 	input, err := os.Open(b.outPath)
 	if err != nil {
 		return err
 	}
 	defer input.Close()
 
+	info, err := input.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+
+	if b.loadHint(fileSize) == nil {
+		b.hinted = true
+		return nil
+	}
+
 	buf := make([]byte, bufSize)
 	in := bufio.NewReaderSize(input, bufSize)
 
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(bufSize)
-
-		if err == io.EOF {
-			if len(header) == 0 {
-				return err
-			}
-		} else if err != nil {
+	for b.outOffset < fileSize {
+		header, err := in.Peek(4)
+		if err != nil && err != io.EOF {
 			return err
 		}
+		if len(header) < 4 {
+			break
+		}
 
-		size := binary.LittleEndian.Uint32(header)
-
-		if size < bufSize {
-			data = buf[:size]
+		size, ok := recordSize(header)
+		if !ok {
+			if active {
+				torn, err := tornTail(input, b.outOffset, fileSize)
+				if err != nil {
+					return err
+				}
+				if torn {
+					break
+				}
+			}
+			return b.corrupted()
+		}
+		if size > fileSize-b.outOffset {
+			break
+		}
+		// Only the last record can be torn.
+		tail := b.outOffset+size == fileSize
+
+		var e Entry
+		if size < bufSize || legacyRecord(header) {
+			var data []byte
+			if size < bufSize {
+				data = buf[:size]
+			} else {
+				data = make([]byte, size)
+			}
+			_, err = io.ReadFull(in, data)
+			if err != nil {
+				return err
+			}
+			if e.Decode(data) != nil || !e.valid() {
+				if tail {
+					break
+				}
+				return b.corrupted()
+			}
 		} else {
-			data = make([]byte, size)
+			// Large values are only passed through the checksum.
+			e, err = skimRecord(in)
+			if err == errCorrupted || (err == nil && !e.valid()) {
+				if tail {
+					break
+				}
+				return b.corrupted()
+			}
+			if err != nil {
+				return err
+			}
+			if e.isBatch() {
+				if e, err = readEntry(input, b.outOffset); err != nil {
+					return err
+				}
+			}
 		}
+		if b.indexEntry(&e, b.outOffset, size) != nil {
+			if tail {
+				break
+			}
+			return b.corrupted()
+		}
+		b.outOffset += size
+	}
 
-		n, err = in.Read(data)
+	if b.outOffset < fileSize {
+		if !active {
+			return b.corrupted()
+		}
+		b.dropped = fileSize - b.outOffset
+		if b.readOnly {
+			return nil
+		}
+		return os.Truncate(b.outPath, b.outOffset)
+	}
+	return nil
+}
 
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
+// tornTail reports whether the bad header at the offset starts a torn tail:
+// the bytes after it are zeros or too few for any record.
+func tornTail(in io.ReaderAt, offset, fileSize int64) (bool, error) {
+	if fileSize-offset < minRecordSize {
+		return true, nil
+	}
+	buf := make([]byte, bufSize)
+	for pos := offset + 4; pos < fileSize; {
+		n, err := in.ReadAt(buf[:min(int64(len(buf)), fileSize-pos)], pos)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		if n == 0 {
+			break
+		}
+		for _, c := range buf[:n] {
+			if c != 0 {
+				return false, nil
 			}
-
-			var e Entry
-			e.Decode(data)
-			b.index[e.key] = b.outOffset
-			b.outOffset += int64(n)
 		}
+		pos += int64(n)
 	}
+	return true, nil
+}
 
-	return err
+func (b *block) corrupted() error {
+	return fmt.Errorf("segment %s: %w at offset %d, run dbtool repair", filepath.Base(b.outPath), errCorrupted, b.outOffset)
 }
 
+// close waits until the pending writes are flushed. It must not be called
+// while the block is read or written to.
 func (b *block) close() error {
-	b.cancel()
+	if b.readOnly {
+		if reader := b.reader.Swap(nil); reader != nil {
+			return reader.Close()
+		}
+		return nil
+	}
 	close(b.writeCh)
+	<-b.writeDone
+	if reader := b.reader.Swap(nil); reader != nil {
+		reader.Close()
+	}
 	return b.segment.Close()
 }
 
-func (b *block) get(key string) (string, error) {
+// readHandle returns the file used for all the lookups in the block. Reads
+// go through ReadAt, so they do not share a position.
+func (b *block) readHandle() (*os.File, error) {
+	if reader := b.reader.Load(); reader != nil {
+		return reader, nil
+	}
+
+	b.readerMu.Lock()
+	defer b.readerMu.Unlock()
+	if reader := b.reader.Load(); reader != nil {
+		return reader, nil
+	}
+	reader, err := os.Open(b.outPath)
+	if err != nil {
+		return nil, err
+	}
+	b.reader.Store(reader)
+	return reader, nil
+}
+
+// locate returns the position of the newest record for the key in the block.
+func (b *block) locate(key string) (int64, error) {
 	b.rwmu.RLock()
+	loc, ok := b.index[key]
+	_, deleted := b.deleted[key]
 	b.rwmu.RUnlock()
 
-	position, ok := b.index[key]
-
 	if !ok {
-		return "", ErrNotFound
+		return 0, ErrNotFound
+	}
+	if deleted {
+		return 0, errDeleted
 	}
+	return loc.offset, nil
+}
 
-	file, err := os.Open(b.outPath)
+func (b *block) get(key string) (Entry, error) {
+	position, err := b.locate(key)
 	if err != nil {
-		return "",  err
+		return Entry{}, err
 	}
-	defer file.Close()
+	return b.read(key, position)
+}
 
-	_, err = file.Seek(position, 0)
+// read reads the record of the key at the position, which may be a tombstone.
+func (b *block) read(key string, position int64) (Entry, error) {
+	file, err := b.readHandle()
 	if err != nil {
-		return "", err
+		return Entry{}, err
 	}
-
-	reader := bufio.NewReader(file)
-	value, ch, err := readValue(reader)
+	e, err := readEntry(file, position)
 	if err != nil {
-		return "", err
+		return Entry{}, err
 	}
 
+	if e.key != key || !e.valid() {
+		return Entry{}, errCorrupted
+	}
+	return e, nil
+}
+
+// append writes the entry of the argument and sets its version unless it is
+// replicated. A non-nil prepare is called by the writer once all the previous
+// writes are indexed, it can change the entry or cancel the write by
+// returning an error.
+func (b *block) append(arg writeArgument) error {
+	arg.resultCh = make(chan writeResult, 1)
+	b.writeCh <- arg
+	result := <-arg.resultCh
+	return result.err
+}
 
-	if ch != calculateChecksum(key + value) {
-		return "", fmt.Errorf("corrupted file")
+// indexEntry points the index to the record of the size written at the
+// offset. Entries of a batch are indexed at their own offsets inside the batch
+// record, so they are read back as regular records.
+func (b *block) indexEntry(e *Entry, offset, size int64) error {
+	if !e.isBatch() {
+		b.index[e.key] = location{offset, size}
+		b.markDeleted(e.key, e.isTombstone())
+		b.versionWritten(e.version)
+		return nil
 	}
 
-	_, err = file.Seek(position, 0)
+	// Decode the whole batch first, so a malformed one leaves no trace in the index.
+	locations := make(map[string]location)
+	deleted := make(map[string]bool)
+	err := e.batchEntries(func(inner *Entry, innerOffset, innerSize int64) {
+		locations[inner.key] = location{offset + innerOffset, innerSize}
+		deleted[inner.key] = inner.isTombstone()
+	})
 	if err != nil {
-		return "", err
+		return err
+	}
+	for key, loc := range locations {
+		b.index[key] = loc
+		b.markDeleted(key, deleted[key])
 	}
-	return value, nil
+	b.versionWritten(e.version)
+	return nil
 }
 
-func (b *block) put(key, value string) error {
-	e := Entry{
-		key:   key,
-		value: value,
+func (b *block) versionWritten(version uint64) {
+	if version > b.maxVersion {
+		b.maxVersion = version
 	}
-	e.checksum = calculateChecksum(key + value)
+}
 
-	resultCh := make(chan writeResult)
-	b.writeCh <- writeArgument{resultCh, e.Encode()}
-	result := <-resultCh
-	close(resultCh)
+// lastWritten returns the size of the acknowledged records and the highest version among them.
+func (b *block) lastWritten() (int64, uint64) {
+	b.rwmu.RLock()
+	defer b.rwmu.RUnlock()
+	return b.outOffset, b.maxVersion
+}
 
-	if result.err == nil {
-		b.rwmu.Lock()
-		b.index[key] = b.outOffset
-		b.outOffset += int64(result.n)
-		b.rwmu.Unlock()
+// raiseVersion makes the counter at least the version.
+func raiseVersion(counter *atomic.Uint64, version uint64) {
+	for {
+		current := counter.Load()
+		if current >= version || counter.CompareAndSwap(current, version) {
+			return
+		}
 	}
+}
 
-	return result.err
+func (b *block) markDeleted(key string, deleted bool) {
+	if deleted {
+		b.deleted[key] = struct{}{}
+	} else {
+		delete(b.deleted, key)
+	}
 }
 
 
@@ -186,21 +401,161 @@ type writeResult struct {
 
 type writeArgument struct {
 	resultCh chan writeResult
-	data     []byte
+	entry    *Entry
+	prepare  func(e *Entry) error
+	// replicated records keep the versions of the primary, including 0 of
+	// the records written before versions.
+	replicated bool
+	// record is copied as is instead of encoding the entry, which has only
+	// the fields after the value then.
+	record *io.SectionReader
+}
+
+// pendingWrite is a record written to the segment, which is not yet indexed
+// and acknowledged.
+type pendingWrite struct {
+	arg    writeArgument
+	offset int64
+	result writeResult
 }
 
-func (b *block) write(ctx context.Context) {
+// write is the only goroutine appending to the segment. Records become
+// visible to get and are acknowledged after the fsync required by the
+// durability mode.
+func (b *block) write(durability Durability) {
+	defer close(b.writeDone)
+
+	var tick <-chan time.Time
+	if durability.Mode == SyncInterval {
+		ticker := time.NewTicker(durability.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	offset := b.outOffset
+	var pending []pendingWrite
+	writeRecord := func(arg writeArgument) {
+		if arg.prepare != nil {
+			// A conditional write has to see the records written before it.
+			b.commit(pending, durability.Mode != SyncNever)
+			pending = pending[:0]
+			if err := arg.prepare(arg.entry); err != nil {
+				arg.resultCh <- writeResult{err: err}
+				return
+			}
+		}
+		if b.versions != nil {
+			if arg.replicated {
+				raiseVersion(b.versions, arg.entry.version)
+			} else if err := arg.entry.setVersion(b.versions.Add(1)); err != nil {
+				arg.resultCh <- writeResult{err: err}
+				return
+			}
+		}
+		var (
+			n   int
+			err error
+		)
+		if arg.record != nil {
+			n, err = copyRecord(b.segment, arg.record)
+		} else {
+			n, err = arg.entry.writeTo(b.segment)
+		}
+		pending = append(pending, pendingWrite{arg, offset, writeResult{n, err}})
+		offset += int64(n)
+	}
+
 	for {
 		select {
-		case <-ctx.Done():
-			return
-		case arg := <-b.writeCh:
-			n, err := b.segment.Write(arg.data)
-			arg.resultCh <- writeResult{n, err}
+		case arg, ok := <-b.writeCh:
+			if !ok {
+				b.commit(pending, durability.Mode != SyncNever)
+				return
+			}
+			writeRecord(arg)
+			if durability.Mode == SyncInterval {
+				continue
+			}
+
+			// Take the writes that queued up meanwhile, so they share one fsync.
+			closed := false
+		drain:
+			for {
+				select {
+				case arg, ok := <-b.writeCh:
+					if !ok {
+						closed = true
+						break drain
+					}
+					writeRecord(arg)
+				default:
+					break drain
+				}
+			}
+			b.commit(pending, durability.Mode == SyncAlways)
+			pending = pending[:0]
+			if closed {
+				return
+			}
+		case <-tick:
+			if len(pending) > 0 {
+				b.commit(pending, true)
+				pending = pending[:0]
+			}
 		}
 	}
 }
 
+// commit syncs the segment if needed, indexes the written records and acknowledges them.
+func (b *block) commit(pending []pendingWrite, sync bool) {
+	if len(pending) == 0 {
+		return
+	}
+
+	var syncErr error
+	if sync {
+		syncErr = b.segment.Sync()
+	} else {
+		b.unsynced.Store(true)
+	}
+
+	b.rwmu.Lock()
+	for i := range pending {
+		p := &pending[i]
+		b.outOffset += int64(p.result.n)
+		if p.result.err == nil {
+			p.result.err = syncErr
+		}
+		if p.result.err == nil {
+			p.result.err = b.indexEntry(p.arg.entry, p.offset, int64(p.result.n))
+		}
+	}
+	b.rwmu.Unlock()
+
+	for _, p := range pending {
+		p.arg.resultCh <- p.result
+	}
+}
+
+// sync flushes the records acknowledged without an fsync to the disk.
+func (b *block) sync() error {
+	if b.readOnly || !b.unsynced.Swap(false) {
+		return nil
+	}
+	if err := b.segment.Sync(); err != nil {
+		b.unsynced.Store(true)
+		return err
+	}
+	return nil
+}
+
+// written returns the number of bytes appended to the segment.
+func (b *block) written() int64 {
+	b.rwmu.RLock()
+	defer b.rwmu.RUnlock()
+	return b.outOffset
+}
+
 func (b *block) size() (int64, error) {
 	info, err := os.Stat(b.outPath)
 	if err != nil {
@@ -211,19 +566,35 @@ func (b *block) size() (int64, error) {
 	return currentSize, nil
 }
 
-func mergeAll(blocks []*block) (*block, error) {
+// mergeAll copies the live records of the blocks into a new one. Records
+// expired by now are dropped like the deleted ones.
+func mergeAll(blocks []*block, now time.Time, oldest bool) (*block, error) {
 	if len(blocks) == 0 {
 		return nil, fmt.Errorf("empty array of blocks")
 	}
 
-	newBlock, err := newBlock(blocks[0].outPath+"-temp", "")
+	tempPath := blocks[0].outPath + tempSuffix
+	err := os.Remove(tempPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	newBlock, err := newBlock(filepath.Dir(tempPath), filepath.Base(tempPath), Durability{}, nil, false)
 	if err != nil {
 		return nil, err
 	}
+	// Keep the highest version even if its record is dropped, so it is not
+	// assigned again after a restart.
+	for _, b := range blocks {
+		newBlock.versionWritten(b.maxVersion)
+	}
 
+	// Keys already seen in a newer block, including the deleted and expired ones that are not copied at all.
+	seen := make(map[string]struct{})
 	for j := len(blocks) - 1; j >= 0; j-- {
-		err = mergeTwoBlocks(newBlock, blocks[j])
+		err = mergeTwoBlocks(newBlock, blocks[j], seen, now, oldest)
 		if err != nil {
+			newBlock.close()
+			newBlock.delete()
 			return nil, err
 		}
 	}
@@ -231,25 +602,70 @@ func mergeAll(blocks []*block) (*block, error) {
 	return newBlock, nil
 }
 
-func mergeTwoBlocks(destBlock, srcBlock *block) error {
-	for key := range srcBlock.index {
-		_, ok := destBlock.index[key]
-		if !ok {
-			val, err := srcBlock.get(key)
-			if err != nil {
-				return err
-			}
-			destBlock.put(key, val)
+// mergeTwoBlocks copies the newest records of the keys not seen yet. Deleted
+// and expired keys are dropped only when the blocks are the oldest ones,
+// otherwise their records have to hide the older values.
+func mergeTwoBlocks(destBlock, srcBlock *block, seen map[string]struct{}, now time.Time, oldest bool) error {
+	file, err := srcBlock.readHandle()
+	if err != nil {
+		return err
+	}
+	for key, loc := range srcBlock.index {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		if _, deleted := srcBlock.deleted[key]; deleted && oldest {
+			continue
+		}
+		arg, err := copyArgument(file, key, loc)
+		if err != nil {
+			return err
+		}
+		if oldest && arg.entry.expired(now) {
+			continue
+		}
+		err = destBlock.append(arg)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// copyArgument returns the write copying the record of the key at the
+// location with its version, so its value is never held in memory. Legacy
+// records are small, they are decoded to be rewritten in the current format.
+func copyArgument(file *os.File, key string, loc location) (writeArgument, error) {
+	header := make([]byte, 4)
+	if _, err := file.ReadAt(header, loc.offset); err != nil {
+		return writeArgument{}, err
+	}
+	if legacyRecord(header) {
+		e, err := readEntry(file, loc.offset)
+		if err == nil && (e.key != key || !e.valid()) {
+			err = errCorrupted
+		}
+		return writeArgument{entry: &e}, err
+	}
+
+	e, _, err := openRecord(file, loc.offset)
+	if err == nil && e.key != key {
+		err = errCorrupted
+	}
+	return writeArgument{entry: &e, record: io.NewSectionReader(file, loc.offset, loc.size)}, err
+}
+
 func (b *block) delete() error {
-	err := os.Remove(b.segment.Name())
+	err := os.Remove(b.outPath)
 	if err != nil {
 		return err
 	}
 
+	err = os.Remove(hintPath(b.outPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
\ No newline at end of file
@@ -0,0 +1,161 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// bucketsDir is the subdirectory of the data directory holding a directory
+// per bucket. Recovery of the database skips it.
+const bucketsDir = "buckets"
+
+var bucketNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// bucketSet holds the open buckets of a database. It is nil for the buckets
+// themselves, which can't have nested ones.
+type bucketSet struct {
+	mu       sync.Mutex
+	opts     Options
+	readOnly bool
+	open     map[string]*Db
+}
+
+// Bucket returns the named keyspace of the database, or ErrNotFound if it was
+// never created. A bucket has the whole Db API with its own index and segments
+// in the buckets directory; it is opened with the options of the database on
+// the first use and closed with it, so the returned handle must not be closed.
+// Buckets of a read-only database are read-only. Changes covers only the
+// default keyspace, buckets are not replicated.
+func (db *Db) Bucket(name string) (*Db, error) {
+	return db.bucket(name, false)
+}
+
+// CreateBucket returns the named bucket like Bucket, creating it if needed.
+// Bucket names are up to 64 letters, digits, '_', '-' and '.' starting with
+// a letter or a digit.
+func (db *Db) CreateBucket(name string) (*Db, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	return db.bucket(name, true)
+}
+
+func (db *Db) bucket(name string, create bool) (*Db, error) {
+	if db.buckets == nil {
+		return nil, fmt.Errorf("buckets can't be nested")
+	}
+	if !bucketNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid bucket name %q", name)
+	}
+
+	db.buckets.mu.Lock()
+	defer db.buckets.mu.Unlock()
+	if b, ok := db.buckets.open[name]; ok {
+		return b, nil
+	}
+	select {
+	case <-db.stopCh:
+		return nil, errClosed
+	default:
+	}
+
+	dir := filepath.Join(db.dir, bucketsDir, name)
+	if !create {
+		info, err := os.Stat(dir)
+		if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	b, err := open(dir, db.buckets.opts, db.buckets.readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("bucket %s: %w", name, err)
+	}
+	b.buckets = nil
+	db.buckets.open[name] = b
+	return b, nil
+}
+
+// Buckets returns the names of the buckets in the data directory, including
+// the empty ones, in ascending order.
+func (db *Db) Buckets() ([]string, error) {
+	if db.buckets == nil {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(filepath.Join(db.dir, bucketsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && bucketNamePattern.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// compactBuckets compacts every bucket, opening the ones not used yet.
+func (db *Db) compactBuckets() error {
+	names, err := db.Buckets()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		b, err := db.Bucket(name)
+		if err != nil {
+			return err
+		}
+		if err := b.Compact(); err != nil {
+			return fmt.Errorf("bucket %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// closeBuckets closes the open buckets and returns the first error.
+func (db *Db) closeBuckets() error {
+	if db.buckets == nil {
+		return nil
+	}
+	db.buckets.mu.Lock()
+	defer db.buckets.mu.Unlock()
+	var res error
+	for name, b := range db.buckets.open {
+		if err := b.Close(); err != nil && res == nil {
+			res = fmt.Errorf("bucket %s: %w", name, err)
+		}
+		delete(db.buckets.open, name)
+	}
+	return res
+}
+
+// snapshotBuckets saves the buckets to the buckets directory of the snapshot.
+// Each bucket is consistent on its own, writes to different buckets are not
+// ordered.
+func (db *Db) snapshotBuckets(dir string) error {
+	names, err := db.Buckets()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		b, err := db.Bucket(name)
+		if err != nil {
+			return err
+		}
+		if err := b.Snapshot(filepath.Join(dir, bucketsDir, name)); err != nil {
+			return fmt.Errorf("bucket %s: %w", name, err)
+		}
+	}
+	return nil
+}
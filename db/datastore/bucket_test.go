@@ -0,0 +1,150 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Bucket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	check := func(t *testing.T, db *Db, key, want string) {
+		t.Helper()
+		value, err := db.Get(key)
+		if want == "" {
+			if err != ErrNotFound {
+				t.Errorf("ERROR!\nExpected: %v;\nGot: %s (%v)", ErrNotFound, value, err)
+			}
+		} else if err != nil || value != want {
+			t.Errorf("ERROR!\nExpected: %s;\nGot: %s (%v)", want, value, err)
+		}
+	}
+
+	if err := db.Put("key", "default"); err != nil {
+		t.Fatal(err)
+	}
+	teams, err := db.CreateBucket("teams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := teams.Put("key", "teams"); err != nil {
+		t.Fatal(err)
+	}
+	if err := teams.Put("only-teams", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("separate keyspaces", func(t *testing.T) {
+		check(t, db, "key", "default")
+		check(t, db, "only-teams", "")
+		check(t, teams, "key", "teams")
+		if same, err := db.Bucket("teams"); err != nil || same != teams {
+			t.Errorf("ERROR! Expected the open bucket, got %p (%v)", same, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, bucketsDir, "teams", DefaultOptions().SegmentPrefix+"1")); err != nil {
+			t.Errorf("ERROR! No bucket segment: %s", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := teams.Delete("key"); err != nil {
+			t.Fatal(err)
+		}
+		check(t, teams, "key", "")
+		check(t, db, "key", "default")
+	})
+
+	t.Run("invalid names", func(t *testing.T) {
+		for _, name := range []string{"", ".", "..", "_batch", "a/b", `a\b`, string(make([]byte, 65))} {
+			if _, err := db.CreateBucket(name); err == nil {
+				t.Errorf("ERROR! Expected error for bucket %q", name)
+			}
+		}
+		if _, err := teams.CreateBucket("nested"); err == nil {
+			t.Error("ERROR! Expected error for a nested bucket")
+		}
+	})
+
+	t.Run("missing bucket", func(t *testing.T) {
+		if _, err := db.Bucket("missing"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, bucketsDir, "missing")); !os.IsNotExist(err) {
+			t.Errorf("ERROR! The bucket is created: %v", err)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if _, err := db.CreateBucket("empty"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := db.Buckets()
+		if err != nil || !reflect.DeepEqual(names, []string{"empty", "teams"}) {
+			t.Errorf("ERROR!\nExpected: [empty teams];\nGot: %v (%v)", names, err)
+		}
+		teams, err = db.Bucket("teams")
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, "key", "default")
+		check(t, teams, "key", "")
+		check(t, teams, "only-teams", "value")
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		snapshotDir := filepath.Join(dir, "..", filepath.Base(dir)+"-snapshot")
+		restoredDir := filepath.Join(dir, "..", filepath.Base(dir)+"-restored")
+		defer os.RemoveAll(snapshotDir)
+		defer os.RemoveAll(restoredDir)
+
+		if err := db.Snapshot(snapshotDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := Restore(snapshotDir, restoredDir); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := NewDb(restoredDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+		restoredTeams, err := restored.Bucket("teams")
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, restored, "key", "default")
+		check(t, restoredTeams, "only-teams", "value")
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		if err := teams.Put("only-teams", "compacted"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if stats := teams.Stats(); stats.DeadBytes != 0 {
+			t.Errorf("ERROR! The bucket is not compacted, %d dead bytes", stats.DeadBytes)
+		}
+		check(t, teams, "only-teams", "compacted")
+	})
+}
@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats describe the read cache usage. Sizes are in bytes of keys and values.
+type CacheStats struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Entries  int    `json:"entries"`
+	Size     int64  `json:"size"`
+	Capacity int64  `json:"capacity"`
+}
+
+type cacheItem struct {
+	entry Entry
+	size  int64
+}
+
+// lruCache keeps the recently read entries within the capacity in bytes.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	items    map[string]*list.Element
+	order    *list.List // front is the most recently used
+	// generation changes on every invalidation, so a read that started
+	// before it does not put a stale value into the cache.
+	generation uint64
+	hits       uint64
+	misses     uint64
+}
+
+func newLRUCache(capacity int64) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the cached entry and the generation to pass to add on a miss.
+func (c *lruCache) get(key string) (Entry, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return Entry{}, c.generation, false
+	}
+	c.hits++
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheItem).entry, c.generation, true
+}
+
+// add caches the entry read from the segments unless the cache was
+// invalidated after the read had started.
+func (c *lruCache) add(e Entry, generation uint64) {
+	size := int64(len(e.key) + len(e.value))
+	if size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if el, ok := c.items[e.key]; ok {
+		c.removeElement(el)
+	}
+	c.items[e.key] = c.order.PushFront(&cacheItem{e, size})
+	c.size += size
+	for c.size > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *lruCache) removeElement(el *list.Element) {
+	item := el.Value.(*cacheItem)
+	c.order.Remove(el)
+	delete(c.items, item.entry.key)
+	c.size -= item.size
+}
+
+func (c *lruCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lruCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+	c.size = 0
+}
+
+func (c *lruCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Entries:  len(c.items),
+		Size:     c.size,
+		Capacity: c.capacity,
+	}
+}
+
+// CacheStats returns the read cache counters, they are zero when the cache is disabled.
+func (db *Db) CacheStats() CacheStats {
+	if db.cache == nil {
+		return CacheStats{}
+	}
+	return db.cache.stats()
+}
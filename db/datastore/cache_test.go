@@ -0,0 +1,124 @@
+package datastore
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDb_Cache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.CacheSize = 100
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("gods", "2024-05-01"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("hits and misses", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			if value, err := db.Get("gods"); err != nil || value != "2024-05-01" {
+				t.Fatalf("ERROR!\nExpected: 2024-05-01;\nGot: %s (%v)", value, err)
+			}
+		}
+		stats := db.CacheStats()
+		if stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+			t.Errorf("ERROR! Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("invalidation", func(t *testing.T) {
+		if err := db.Put("gods", "2024-05-02"); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.Get("gods"); err != nil || value != "2024-05-02" {
+			t.Errorf("ERROR!\nExpected: 2024-05-02;\nGot: %s (%v)", value, err)
+		}
+
+		wb := new(WriteBatch)
+		wb.Put("gods", "2024-05-03")
+		if err := db.Batch(wb); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.Get("gods"); err != nil || value != "2024-05-03" {
+			t.Errorf("ERROR!\nExpected: 2024-05-03;\nGot: %s (%v)", value, err)
+		}
+
+		if err := db.Delete("gods"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("gods"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	})
+
+	t.Run("size limit", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			key := "key" + strconv.Itoa(i)
+			if err := db.Put(key, strings.Repeat("v", 20)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Get(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stats := db.CacheStats()
+		if stats.Size > opts.CacheSize || stats.Entries != 4 {
+			t.Errorf("ERROR! Unexpected stats %+v", stats)
+		}
+		// The least recently used keys are evicted.
+		misses := stats.Misses
+		if _, err := db.Get("key9"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("key0"); err != nil {
+			t.Fatal(err)
+		}
+		if db.CacheStats().Misses != misses+1 {
+			t.Errorf("ERROR! Unexpected stats %+v", db.CacheStats())
+		}
+	})
+
+	t.Run("merge purges the cache", func(t *testing.T) {
+		db.SetCompactionPolicy(CompactionTrigger{MaxSegments: 1})
+		if err := db.Put("filler", "value"); err != nil {
+			t.Fatal(err)
+		}
+		db.mu.Lock()
+		if err := db.addNewBlockToDB(); err != nil {
+			t.Fatal(err)
+		}
+		db.mu.Unlock()
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		if entries := db.CacheStats().Entries; entries != 0 {
+			t.Errorf("ERROR! Expected empty cache, got %d entries", entries)
+		}
+	})
+}
+
+func TestLRUCache_StaleRead(t *testing.T) {
+	c := newLRUCache(100)
+	_, generation, ok := c.get("key")
+	if ok {
+		t.Fatal("Expected a miss")
+	}
+	// A write invalidates the key while the read is in progress.
+	c.invalidate("key")
+	c.add(Entry{key: "key", value: "old"}, generation)
+	if _, _, ok := c.get("key"); ok {
+		t.Error("Stale value is cached")
+	}
+}
@@ -0,0 +1,316 @@
+package datastore
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tempSuffix marks a segment that is being built by a merge.
+const tempSuffix = "-temp"
+
+var errClosed = fmt.Errorf("database is closed")
+
+// CompactionPolicy decides which of the sealed segments are merged in the
+// background. It is asked when a segment is sealed.
+type CompactionPolicy interface {
+	// Plan gets the sealed segments from the oldest to the newest and returns
+	// the range segments[from:to] to merge into one segment, or an empty range
+	// when nothing needs merging. Deleted and expired records are dropped only
+	// when the range starts at the oldest segment.
+	Plan(segments []SegmentStats) (from, to int)
+}
+
+// CompactionTrigger merges all the sealed segments once there are too many of
+// them. A zero field disables the corresponding condition.
+type CompactionTrigger struct {
+	// MaxSegments starts a compaction when there are more segments, including the active one.
+	MaxSegments int
+	// SizeRatio starts a compaction when the segments sealed after the oldest one
+	// take at least SizeRatio times its size.
+	SizeRatio float64
+}
+
+func (t CompactionTrigger) Plan(segments []SegmentStats) (int, int) {
+	if t.ready(segments) {
+		return 0, len(segments)
+	}
+	return 0, 0
+}
+
+func (t CompactionTrigger) ready(sealed []SegmentStats) bool {
+	if len(sealed) == 0 {
+		return false
+	}
+	if t.MaxSegments > 0 && len(sealed)+1 > t.MaxSegments {
+		return true
+	}
+	if t.SizeRatio > 0 && len(sealed) > 1 {
+		var newer int64
+		for _, s := range sealed[1:] {
+			newer += s.Bytes
+		}
+		return float64(newer) >= t.SizeRatio*float64(sealed[0].Bytes)
+	}
+	return false
+}
+
+// SizeTiered merges runs of adjacent sealed segments of similar sizes, so the
+// merged segments form tiers and a record is rewritten about once per tier
+// instead of on every merge.
+type SizeTiered struct {
+	// MinSegments is the length of a run that is merged, 4 when zero.
+	MinSegments int
+	// MaxRatio is how many times the largest segment of a run may be bigger
+	// than the smallest one, 2 when zero.
+	MaxRatio float64
+}
+
+func (t SizeTiered) Plan(segments []SegmentStats) (int, int) {
+	minSegments, maxRatio := t.MinSegments, t.MaxRatio
+	if minSegments == 0 {
+		minSegments = 4
+	}
+	if maxRatio == 0 {
+		maxRatio = 2
+	}
+	// The oldest run is merged first, it holds the most overwritten records.
+	for from := range segments {
+		smallest, largest := segments[from].Bytes, segments[from].Bytes
+		to := from + 1
+		for ; to < len(segments) && to-from < minSegments; to++ {
+			smallest = min(smallest, segments[to].Bytes)
+			largest = max(largest, segments[to].Bytes)
+			if float64(largest) > maxRatio*float64(smallest) {
+				break
+			}
+		}
+		if to-from == minSegments {
+			return from, to
+		}
+	}
+	return 0, 0
+}
+
+// GarbageRatio merges all the sealed segments once the records overwritten,
+// deleted or shadowed by newer segments take at least Ratio of their size.
+type GarbageRatio struct {
+	Ratio float64
+	// MinDeadBytes skips merges that would reclaim less, so small databases
+	// are not rewritten on every sealed segment.
+	MinDeadBytes int64
+}
+
+func (g GarbageRatio) Plan(segments []SegmentStats) (int, int) {
+	var size, dead int64
+	for _, s := range segments {
+		size += s.Bytes
+		dead += s.DeadBytes
+	}
+	if size == 0 || dead < g.MinDeadBytes || float64(dead) < g.Ratio*float64(size) {
+		return 0, 0
+	}
+	return 0, len(segments)
+}
+
+// ManualCompaction never merges in the background, segments are merged only by Db.Compact.
+type ManualCompaction struct{}
+
+func (ManualCompaction) Plan([]SegmentStats) (int, int) {
+	return 0, 0
+}
+
+func validatePolicy(p CompactionPolicy) error {
+	switch p := p.(type) {
+	case CompactionTrigger:
+		if p.MaxSegments < 0 || p.SizeRatio < 0 {
+			return fmt.Errorf("invalid compaction trigger %+v", p)
+		}
+	case SizeTiered:
+		if p.MinSegments < 0 || p.MinSegments == 1 || p.MaxRatio < 0 || (p.MaxRatio > 0 && p.MaxRatio < 1) {
+			return fmt.Errorf("invalid size-tiered compaction %+v", p)
+		}
+	case GarbageRatio:
+		if p.Ratio <= 0 || p.Ratio > 1 || p.MinDeadBytes < 0 {
+			return fmt.Errorf("invalid garbage ratio compaction %+v", p)
+		}
+	}
+	return nil
+}
+
+// SetCompactionPolicy replaces the policy of background compactions, nil
+// disables them.
+func (db *Db) SetCompactionPolicy(p CompactionPolicy) {
+	db.mu.Lock()
+	db.policy = p
+	db.mu.Unlock()
+	db.scheduleCompaction()
+}
+
+// Compact seals the active segment if it has records and merges all the
+// sealed segments into one whatever the policy is, then does the same in every
+// bucket. It waits for the merges.
+func (db *Db) Compact() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
+	lastBlock := db.blocks[len(db.blocks)-1]
+	if lastBlock.written() > 0 {
+		if err := db.addNewBlockToDB(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		if err := lastBlock.writeHint(); err != nil {
+			log.Printf("Segment %s: can't write hint: %s", lastBlock.outPath, err)
+		}
+	}
+	db.mu.Unlock()
+	if err := db.request(compactRequest{done: make(chan error, 1), force: true}); err != nil {
+		return err
+	}
+	return db.compactBuckets()
+}
+
+type compactRequest struct {
+	done chan error
+	// force merges all the sealed segments without asking the policy.
+	force bool
+}
+
+// scheduleCompaction asks the compaction goroutine to check the policy without waiting for it.
+func (db *Db) scheduleCompaction() {
+	select {
+	case db.compactCh <- compactRequest{}:
+	default:
+		// A check is already pending and will see the current segments.
+	}
+}
+
+// compact asks the compaction goroutine to check the policy and waits until
+// it is done with this and all the previously scheduled checks.
+func (db *Db) compact() error {
+	return db.request(compactRequest{done: make(chan error, 1)})
+}
+
+func (db *Db) request(req compactRequest) error {
+	select {
+	case db.compactCh <- req:
+	case <-db.stopCh:
+		return errClosed
+	}
+	select {
+	case err := <-req.done:
+		return err
+	case <-db.stopCh:
+		return errClosed
+	}
+}
+
+func (db *Db) compactLoop() {
+	defer db.compactWg.Done()
+	for {
+		select {
+		case <-db.stopCh:
+			return
+		case req := <-db.compactCh:
+			err := db.merge(req.force)
+			if req.done != nil {
+				req.done <- err
+			} else if err != nil {
+				log.Printf("Segments compaction failed: %s", err)
+			}
+		}
+	}
+}
+
+// merge replaces the sealed segments planned by the policy, or all of them
+// when forced, with a single one. The merged segment is built while Put and Get
+// keep working with the current blocks and is swapped in under the lock.
+func (db *Db) merge(force bool) error {
+	db.mu.RLock()
+	sealed := db.blocks[:len(db.blocks)-1]
+	from, to := 0, len(sealed)
+	if !force {
+		from, to = 0, 0
+		if db.policy != nil {
+			from, to = db.policy.Plan(segmentStats(db.blocks)[:len(sealed)])
+		}
+	}
+	if from < 0 || to > len(sealed) || from > to {
+		db.mu.RUnlock()
+		return fmt.Errorf("compaction policy planned segments [%d, %d) of %d", from, to, len(sealed))
+	}
+	merged := append([]*block(nil), sealed[from:to]...)
+	db.mu.RUnlock()
+	if len(merged) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err := db.replace(from, merged)
+	db.merges.done(start, err)
+	return err
+}
+
+// replace swaps the blocks starting at the index for the one they are merged
+// into. Deleted and expired records are kept unless there are no older blocks,
+// otherwise the older values would show through, and while the db is
+// replicated, otherwise the followers would keep the older values.
+func (db *Db) replace(from int, merged []*block) error {
+	tempBlock, err := mergeAll(merged, db.now(), from == 0 && !db.keepTombstones.Load())
+	if err != nil {
+		return err
+	}
+	// The merged segment replaces the sealed ones, so it has to be on the disk
+	// before they are removed whatever the durability mode is.
+	err = tempBlock.segment.Sync()
+	if err != nil {
+		tempBlock.close()
+		tempBlock.delete()
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// The merged segment takes the place of the oldest of the blocks as its
+	// next generation, a new name tells a replication cursor that the segment
+	// it points to is gone.
+	id := db.segmentIDOf(merged[0])
+	id.generation++
+	mergedPath := filepath.Join(db.dir, id.fileName(db.segmentName))
+	// An orphan hint must not be taken for the merged segment.
+	err = os.Remove(hintPath(mergedPath))
+	if err == nil || os.IsNotExist(err) {
+		err = os.Rename(tempBlock.outPath, mergedPath)
+	}
+	if err != nil {
+		tempBlock.close()
+		tempBlock.delete()
+		return err
+	}
+	tempBlock.outPath = mergedPath
+	if err := tempBlock.writeHint(); err != nil {
+		log.Printf("Segment %s: can't write hint: %s", mergedPath, err)
+	}
+
+	// Only this goroutine removes blocks, so the merged ones are still in place.
+	blocks := append([]*block(nil), db.blocks[:from]...)
+	blocks = append(blocks, tempBlock)
+	db.blocks = append(blocks, db.blocks[from+len(merged):]...)
+	db.ordered = db.buildKeyIndex()
+	if db.cache != nil {
+		db.cache.purge()
+	}
+	for _, b := range merged {
+		b.close()
+		err := b.delete()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompactionPolicy_Plan(t *testing.T) {
+	sizes := func(bytes ...int64) []SegmentStats {
+		res := make([]SegmentStats, len(bytes))
+		for i, b := range bytes {
+			res[i] = SegmentStats{Bytes: b}
+		}
+		return res
+	}
+	garbage := []SegmentStats{{Bytes: 100, DeadBytes: 60}, {Bytes: 100, DeadBytes: 10}}
+
+	for _, tc := range []struct {
+		name     string
+		policy   CompactionPolicy
+		segments []SegmentStats
+		from, to int
+	}{
+		{"trigger without sealed segments", CompactionTrigger{MaxSegments: 1}, nil, 0, 0},
+		{"trigger by segments", CompactionTrigger{MaxSegments: 2}, sizes(10, 10), 0, 2},
+		{"trigger by size ratio", CompactionTrigger{SizeRatio: 2}, sizes(10, 15, 5), 0, 3},
+		{"trigger below size ratio", CompactionTrigger{SizeRatio: 2}, sizes(10, 15), 0, 0},
+		{"tiered run", SizeTiered{}, sizes(1000, 10, 12, 19, 10, 10), 1, 5},
+		{"tiered oldest run first", SizeTiered{MinSegments: 2}, sizes(40, 30, 10, 10), 0, 2},
+		{"tiered different sizes", SizeTiered{}, sizes(1000, 10, 30, 10, 10), 0, 0},
+		{"tiered short run", SizeTiered{}, sizes(10, 10, 10), 0, 0},
+		{"garbage over ratio", GarbageRatio{Ratio: 0.3}, garbage, 0, 2},
+		{"garbage under ratio", GarbageRatio{Ratio: 0.4}, garbage, 0, 0},
+		{"garbage under min bytes", GarbageRatio{Ratio: 0.3, MinDeadBytes: 100}, garbage, 0, 0},
+		{"garbage without segments", GarbageRatio{Ratio: 0.3}, nil, 0, 0},
+		{"manual", ManualCompaction{}, garbage, 0, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			from, to := tc.policy.Plan(tc.segments)
+			if from != tc.from || to != tc.to {
+				t.Errorf("ERROR!\nExpected: [%d, %d);\nGot: [%d, %d)", tc.from, tc.to, from, to)
+			}
+		})
+	}
+}
+
+func TestDb_CompactionPolicy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Compaction = ManualCompaction{}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	seal := func(t *testing.T) {
+		t.Helper()
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if err := db.addNewBlockToDB(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put := func(t *testing.T, key, value string) {
+		t.Helper()
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(t *testing.T, key, want string) {
+		t.Helper()
+		value, err := db.Get(key)
+		if want == "" {
+			if err != ErrNotFound {
+				t.Errorf("ERROR!\nExpected: %v;\nGot: %s (%v)", ErrNotFound, value, err)
+			}
+		} else if err != nil || value != want {
+			t.Errorf("ERROR!\nExpected: %s;\nGot: %s (%v)", want, value, err)
+		}
+	}
+	names := func() string {
+		var res []string
+		for _, b := range db.blocks {
+			res = append(res, strings.TrimPrefix(b.outPath, dir+string(os.PathSeparator)+opts.SegmentPrefix))
+		}
+		return strings.Join(res, ",")
+	}
+
+	// A large oldest segment and four small ones of similar sizes, the deleted
+	// key has its value in the oldest segment.
+	big := strings.Repeat("b", 1000)
+	put(t, "gone", "old")
+	put(t, "big", big)
+	for i := 2; i <= 5; i++ {
+		seal(t)
+		put(t, "key", "value"+strconv.Itoa(i))
+		if i == 3 {
+			if err := db.Delete("gone"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	seal(t)
+
+	t.Run("manual", func(t *testing.T) {
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		if got := names(); got != "1,2,3,4,5,6" {
+			t.Errorf("ERROR!\nExpected: 1,2,3,4,5,6;\nGot: %s", got)
+		}
+	})
+
+	t.Run("size tiered", func(t *testing.T) {
+		db.SetCompactionPolicy(SizeTiered{})
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		// The merged segment is the next generation of the oldest one it replaces.
+		if got := names(); got != "1,2.1,6" {
+			t.Errorf("ERROR!\nExpected: 1,2.1,6;\nGot: %s", got)
+		}
+		// The tombstone is kept, the oldest segment still has the value.
+		if _, deleted := db.blocks[1].deleted["gone"]; !deleted {
+			t.Error("ERROR! The tombstone is dropped")
+		}
+		check(t, "gone", "")
+		check(t, "key", "value5")
+		check(t, "big", big)
+
+		db.Close()
+		db, err = NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, "gone", "")
+		check(t, "key", "value5")
+	})
+
+	t.Run("compact on demand", func(t *testing.T) {
+		put(t, "key", "value6")
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if got := names(); got != "1.1,7" {
+			t.Errorf("ERROR!\nExpected: 1.1,7;\nGot: %s", got)
+		}
+		if stats := db.Stats(); stats.DeadBytes != 0 || stats.Keys != 2 {
+			t.Errorf("ERROR! Unexpected stats after compaction %+v", stats)
+		}
+		check(t, "gone", "")
+		check(t, "key", "value6")
+
+		// Nothing to seal, the merged segment is merged again.
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if got := names(); got != "1.2,7" {
+			t.Errorf("ERROR!\nExpected: 1.2,7;\nGot: %s", got)
+		}
+	})
+
+	t.Run("garbage ratio", func(t *testing.T) {
+		db.SetCompactionPolicy(GarbageRatio{Ratio: 0.5})
+		put(t, "key", "value7")
+		seal(t)
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		if len(db.blocks) != 3 {
+			t.Fatalf("ERROR! Merged with little garbage: %s", names())
+		}
+
+		put(t, "big", "small")
+		seal(t)
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		if got := names(); got != "1.3,9" {
+			t.Errorf("ERROR!\nExpected: 1.3,9;\nGot: %s", got)
+		}
+		check(t, "big", "small")
+		check(t, "key", "value7")
+	})
+
+	t.Run("interrupted merge", func(t *testing.T) {
+		// A crash after the rename of the merged segment leaves the previous
+		// generation.
+		db.Close()
+		data, err := os.ReadFile(filepath.Join(dir, opts.SegmentPrefix+"1.3"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stale := filepath.Join(dir, opts.SegmentPrefix+"1.2")
+		if err := os.WriteFile(stale, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(); got != "1.3,9" {
+			t.Errorf("ERROR!\nExpected: 1.3,9;\nGot: %s", got)
+		}
+		if _, err := os.Stat(stale); !os.IsNotExist(err) {
+			t.Errorf("ERROR! The previous generation is not removed: %v", err)
+		}
+		check(t, "key", "value7")
+	})
+}
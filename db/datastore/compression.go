@@ -0,0 +1,73 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// compressMinSize is the smallest value worth compressing, gzip adds about 20
+// bytes of its own.
+const compressMinSize = 256
+
+// CompressionStats describes the values written since the database was opened.
+type CompressionStats struct {
+	RawBytes    int64 `json:"rawBytes"`
+	StoredBytes int64 `json:"storedBytes"`
+	// Ratio is RawBytes to StoredBytes, 1 when nothing is compressed.
+	Ratio float64 `json:"ratio"`
+}
+
+func (db *Db) CompressionStats() CompressionStats {
+	stats := CompressionStats{
+		RawBytes:    db.rawBytes.Load(),
+		StoredBytes: db.storedBytes.Load(),
+		Ratio:       1,
+	}
+	if stats.StoredBytes > 0 {
+		stats.Ratio = float64(stats.RawBytes) / float64(stats.StoredBytes)
+	}
+	return stats
+}
+
+// compress gzips the entry value if compression is enabled and pays off. The
+// checksum then covers the compressed value, so recovery and merges check
+// the records without decompressing them.
+func (db *Db) compress(e *Entry) {
+	if e.isTombstone() || e.flags&flagCompressed != 0 || e.body != nil {
+		return
+	}
+
+	raw := len(e.value)
+	if db.compression && raw >= compressMinSize {
+		var buf bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		w.Write([]byte(e.value))
+		if w.Close() == nil && buf.Len() < raw {
+			e.value = buf.String()
+			e.flags |= flagCompressed
+		}
+	}
+	db.rawBytes.Add(int64(raw))
+	db.storedBytes.Add(int64(len(e.value)))
+}
+
+// decompress restores the original value of a compressed entry.
+func (e *Entry) decompress() error {
+	if e.flags&flagCompressed == 0 {
+		return nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader([]byte(e.value)))
+	if err != nil {
+		return errCorrupted
+	}
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return errCorrupted
+	}
+	e.value = string(value)
+	e.flags &^= flagCompressed
+	// The entry no longer matches the stored checksum.
+	e.checksum, e.legacy = "", false
+	return nil
+}
@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_Compression(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Compression = true
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	large := strings.Repeat(`{"team":"gods","score":42},`, 100)
+	if err := db.Put("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small", "value"); err != nil {
+		t.Fatal(err)
+	}
+	wb := new(WriteBatch)
+	wb.Put("batched", large)
+	if err := db.Batch(wb); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+		for key, want := range map[string]string{"large": large, "small": "value", "batched": large} {
+			value, err := db.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != want {
+				t.Errorf("ERROR! %s\nExpected: %d bytes;\nGot: %d bytes", key, len(want), len(value))
+			}
+		}
+	}
+
+	t.Run("values are compressed", func(t *testing.T) {
+		check(t)
+		size, err := db.blocks[0].size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size >= int64(len(large)) {
+			t.Errorf("ERROR! Segment size %d is not smaller than one value of %d bytes", size, len(large))
+		}
+		stats := db.Stats().Compression
+		if stats.RawBytes != int64(2*len(large)+len("value")) || stats.Ratio <= 1 {
+			t.Errorf("ERROR! Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("small values are stored as they are", func(t *testing.T) {
+		e, err := db.blocks[0].get("small")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.flags&flagCompressed != 0 || e.value != "value" {
+			t.Errorf("ERROR! Small value is compressed: %+v", e)
+		}
+	})
+
+	t.Run("read without compression", func(t *testing.T) {
+		db.Close()
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		if err := db.Put("plain", large); err != nil {
+			t.Fatal(err)
+		}
+		if stats := db.Stats().Compression; stats.Ratio != 1 {
+			t.Errorf("ERROR! Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("merge keeps compressed values", func(t *testing.T) {
+		db.SetCompactionPolicy(CompactionTrigger{MaxSegments: 1})
+		db.mu.Lock()
+		if err := db.addNewBlockToDB(); err != nil {
+			t.Fatal(err)
+		}
+		db.mu.Unlock()
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		e, err := db.blocks[0].get("large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.flags&flagCompressed == 0 {
+			t.Error("ERROR! The merged value is not compressed")
+		}
+	})
+}
@@ -2,68 +2,176 @@ package datastore
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
-)
-var (
-	outFileName = "segment-data-"
-	outFileSize int64 = 10000000
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // db
 type Db struct {
+	// mu guards blocks and segmentNumber. Sealed blocks are immutable, so they
+	// can be read by the compaction goroutine without holding it.
+	mu     sync.RWMutex
 	blocks []*block
+	// ordered holds the keys of all blocks for scans. It is rebuilt after
+	// recovery and compactions, until then it can keep deleted keys.
+	ordered *skipList
+	// cache is nil when Options.CacheSize is zero.
+	cache *lruCache
 
 	dir           string
 	segmentName   string
 	segmentNumber int
 	segmentSize   int64
+	durability    Durability
+	// now is the clock used to expire records.
+	now func() time.Time
+	// versions holds the last version assigned to a record.
+	versions atomic.Uint64
+
+	compression bool
+	// keepTombstones is set by Options.KeepTombstones and by Changes.
+	keepTombstones atomic.Bool
+	// rawBytes and storedBytes sum the sizes of the written values before
+	// and after compression.
+	rawBytes, storedBytes atomic.Int64
+
+	// getLatency and putLatency time db.get and db.appendIf.
+	getLatency, putLatency histogram
+	merges                 mergeCounters
+
+	buckets *bucketSet
+	// readOnly databases have no compaction goroutine and reject writes.
+	readOnly bool
+	// lock is the lock file of the data directory, it is nil for a
+	// read-only database of a directory never opened for writing.
+	lock *os.File
+
+	policy    CompactionPolicy
+	compactCh chan compactRequest
+	stopCh    chan struct{}
+	compactWg sync.WaitGroup
 }
 
+// ErrReadOnly is returned by the writes to a database opened with OpenReadOnly.
+var ErrReadOnly = fmt.Errorf("database is opened read-only")
+
 func NewDb(dir string) (*Db, error) {
+	return NewDbWithOptions(dir, DefaultOptions())
+}
+
+// NewDbWithOptions opens the database in dir for reads and writes, creating
+// the directory if needed. It fails with ErrLocked while the directory is
+// open in another process or by another Db.
+func NewDbWithOptions(dir string, opts Options) (*Db, error) {
+	return open(dir, opts, false)
+}
+
+// OpenReadOnly opens an existing database for Get and scans. It does not
+// change the segments: they are not merged, torn records are not truncated
+// and writes fail with ErrReadOnly. Readers share the directory with each
+// other but not with a database opened for writing; the lock file is created
+// if it is missing, so the directory has to be writable.
+func OpenReadOnly(dir string) (*Db, error) {
+	return OpenReadOnlyWithOptions(dir, DefaultOptions())
+}
+
+// OpenReadOnlyWithOptions opens an existing database like OpenReadOnly,
+// only the segment prefix and the cache size options are used.
+func OpenReadOnlyWithOptions(dir string, opts Options) (*Db, error) {
+	return open(dir, opts, true)
+}
+
+func open(dir string, opts Options, readOnly bool) (*Db, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
 	db := &Db{
 		dir:         dir,
-		segmentName: outFileName,
-		segmentSize: outFileSize,
+		segmentName: opts.SegmentPrefix,
+		segmentSize: opts.SegmentSize,
+		durability:  opts.Durability,
+		compression: opts.Compression,
+		now:         time.Now,
+		policy:      opts.Compaction,
+		readOnly:    readOnly,
+		buckets:     &bucketSet{opts: opts, readOnly: readOnly, open: make(map[string]*Db)},
+		compactCh:   make(chan compactRequest, 1),
+		stopCh:      make(chan struct{}),
+	}
+
+	db.keepTombstones.Store(opts.KeepTombstones)
+	if opts.CacheSize > 0 {
+		db.cache = newLRUCache(opts.CacheSize)
 	}
 
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) && !readOnly {
 		os.MkdirAll(dir, os.ModePerm)
 	}
 
-	f, err := os.Open(dir)
+	var err error
+	db.lock, err = lockDir(dir, !readOnly)
 	if err != nil {
 		return nil, err
 	}
+	if err := db.load(); err != nil {
+		for _, b := range db.blocks {
+			b.close()
+		}
+		db.lock.Close()
+		return nil, err
+	}
+	db.ordered = db.buildKeyIndex()
+	if readOnly {
+		return db, nil
+	}
+
+	db.compactWg.Add(1)
+	go db.compactLoop()
+	db.scheduleCompaction()
+
+	return db, nil
+}
+
+// load recovers the blocks from the data directory, a new database gets its
+// first segment.
+func (db *Db) load() error {
+	f, err := os.Open(db.dir)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
 
 	filesNames, err := f.Readdirnames(0)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if len(filesNames) != 0 {
-		err := db.recover(filesNames)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		err = db.addNewBlockToDB()
-		if err != nil {
-			return nil, err
+	err = db.recover(filesNames)
+	if err != nil {
+		return err
+	}
+	if len(db.blocks) == 0 {
+		if db.readOnly {
+			return fmt.Errorf("no segments in %s", db.dir)
 		}
+		return db.addNewBlockToDB()
 	}
-
-	return db, nil
+	return nil
 }
 
 func (db *Db) addNewBlockToDB() error {
 	db.segmentNumber++
 	b, err := newBlock(db.dir,
-		db.segmentName+strconv.Itoa((db.segmentNumber)))
+		segmentID{number: db.segmentNumber}.fileName(db.segmentName), db.durability, &db.versions, true)
 	if err != nil {
 		return err
 	}
@@ -71,106 +179,455 @@ func (db *Db) addNewBlockToDB() error {
 	return nil
 }
 
-func (db *Db) recover(filesNames []string) error { // sort by growth
-	sort.Strings(filesNames)
+// segmentPattern matches the names of segments and their hints, the groups
+// are the segment number, the merge generation and the hint suffix.
+func segmentPattern(prefix string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + `([0-9]+)(?:\.([0-9]+))?(` + regexp.QuoteMeta(hintSuffix) + ")?$")
+}
+
+// segmentID orders the segments. A merged segment gets the number of the
+// oldest segment it replaces and the next generation, so it keeps its place
+// and a segment name is never used twice.
+type segmentID struct {
+	number, generation int
+}
+
+// parseSegmentID parses the groups matched by segmentPattern.
+func parseSegmentID(match []string) (segmentID, error) {
+	var id segmentID
+	var err error
+	id.number, err = strconv.Atoi(match[1])
+	if err == nil && match[2] != "" {
+		id.generation, err = strconv.Atoi(match[2])
+	}
+	return id, err
+}
+
+func (id segmentID) less(other segmentID) bool {
+	if id.number != other.number {
+		return id.number < other.number
+	}
+	return id.generation < other.generation
+}
+
+func (id segmentID) fileName(prefix string) string {
+	if id.generation == 0 {
+		return prefix + strconv.Itoa(id.number)
+	}
+	return prefix + strconv.Itoa(id.number) + "." + strconv.Itoa(id.generation)
+}
+
+// segmentIDOf returns the id of the block segment.
+func (db *Db) segmentIDOf(b *block) segmentID {
+	match := segmentPattern(db.segmentName).FindStringSubmatch(filepath.Base(b.outPath))
+	if match == nil {
+		return segmentID{}
+	}
+	id, _ := parseSegmentID(match)
+	return id
+}
+
+func (db *Db) recover(filesNames []string) error {
 	// regexp for checking file names
-	r, _ := regexp.Compile(db.segmentName + "[0-9]+")
+	r := segmentPattern(db.segmentName)
+	ids := make(map[string]segmentID)
+	var segments, hints []string
 	for _, fileName := range filesNames {
-		match := r.MatchString(fileName)
+		if fileName == bucketsDir || fileName == lockName || fileName == cursorName {
+			continue
+		}
+		// Leftover of a merge, a hint write or a streamed value write
+		// interrupted by a crash, the source files are still in place.
+		if strings.HasSuffix(fileName, tempSuffix) {
+			if db.readOnly {
+				continue
+			}
+			err := os.Remove(filepath.Join(db.dir, fileName))
+			if err != nil {
+				return err
+			}
+			continue
+		}
 
-		if match {
-			b, err := newBlock(db.dir, fileName)
+		match := r.FindStringSubmatch(fileName)
+		if match == nil {
+			return fmt.Errorf("wrongly named file in the working directory: %v. Current file neme pattern: %v + int number", fileName, db.segmentName)
+		}
+		if match[3] != "" {
+			hints = append(hints, fileName)
+			continue
+		}
+		id, err := parseSegmentID(match)
+		if err != nil {
+			return err
+		}
+		ids[fileName] = id
+		segments = append(segments, fileName)
+	}
+
+	// A hint without its segment is left when a crash interrupts a merge.
+	for _, fileName := range hints {
+		if _, ok := ids[strings.TrimSuffix(fileName, hintSuffix)]; !ok && !db.readOnly {
+			err := os.Remove(filepath.Join(db.dir, fileName))
 			if err != nil {
 				return err
 			}
-			db.blocks = append(db.blocks, b)
-			reg, _ := regexp.Compile("[0-9]+")
-			db.segmentNumber, err = strconv.Atoi(reg.FindString(fileName))
+		}
+	}
+
+	// sort by growth
+	sort.Slice(segments, func(i, j int) bool {
+		return ids[segments[i]].less(ids[segments[j]])
+	})
+	// A merged segment is renamed into place before the segments it replaces
+	// are removed, a crash in between leaves the older generations.
+	current := segments[:0]
+	for i, fileName := range segments {
+		if i+1 < len(segments) && ids[segments[i+1]].number == ids[fileName].number {
+			if !db.readOnly {
+				if err := (&block{outPath: filepath.Join(db.dir, fileName)}).delete(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		current = append(current, fileName)
+	}
+	segments = current
+	for i, fileName := range segments {
+		active := i == len(segments)-1
+		if db.readOnly {
+			b, err := openReadOnlyBlock(db.dir, fileName, active)
 			if err != nil {
 				return err
 			}
-		} else {
-			return fmt.Errorf("wrongly named file in the working directory: %v. Current file neme pattern: %v + int number", fileName, db.segmentName)
+			if b.dropped > 0 {
+				log.Printf("Segment %s: ignored %d bytes of a torn record", fileName, b.dropped)
+			}
+			db.blocks = append(db.blocks, b)
+			db.segmentNumber = ids[fileName].number
+			raiseVersion(&db.versions, b.maxVersion)
+			continue
 		}
+
+		b, err := newBlock(db.dir, fileName, db.durability, &db.versions, active)
+		if err != nil {
+			return err
+		}
+		if b.dropped > 0 {
+			log.Printf("Segment %s: dropped %d bytes of a torn record", fileName, b.dropped)
+		}
+		// The next start can skip the scan of sealed segments.
+		if !b.hinted && i < len(segments)-1 {
+			if err := b.writeHint(); err != nil {
+				log.Printf("Segment %s: can't write hint: %s", fileName, err)
+			}
+		}
+		db.blocks = append(db.blocks, b)
+		db.segmentNumber = ids[fileName].number
+		raiseVersion(&db.versions, b.maxVersion)
 	}
 	return nil
 }
 
 func (db *Db) Close() error {
+	close(db.stopCh)
+	err := db.closeBuckets()
+	db.compactWg.Wait()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	for _, block := range db.blocks {
 		block.close()
 	}
-	return nil
+	if db.lock != nil {
+		db.lock.Close()
+	}
+	return err
 }
 
 func (db *Db) Put(key, value string) error {
-	lastBlock := db.blocks[len(db.blocks)-1]
-	curSize, err := lastBlock.size()
-	if err != nil {
-		return err
+	return db.append(newValueEntry(key, value, typeString))
+}
+
+func (db *Db) PutInt64(key string, value int64) error {
+	return db.append(newValueEntry(key, encodeInt64(value), typeInt64))
+}
+
+func (db *Db) PutBytes(key string, value []byte) error {
+	return db.append(newValueEntry(key, string(value), typeBytes))
+}
+
+// PutWithTTL stores a string value, which is no longer returned by Get once
+// the ttl passes and is dropped from the segments on the next merge.
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %s", ttl)
 	}
+	e := newValueEntry(key, value, typeString)
+	e.expiresAt = db.now().Add(ttl).UnixNano()
+	return db.append(e)
+}
 
-	if curSize <= db.segmentSize {
-		err := lastBlock.put(key, value)
-		if err != nil {
+// Increment adds delta to the int64 value of the key and returns the result.
+// A missing key counts as zero, a value of another type fails with
+// ErrWrongType. The new value is computed by the segment writer, so
+// concurrent increments are never lost.
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	var result int64
+	e := newValueEntry(key, "", typeInt64)
+	err := db.appendIf(&e, func(e *Entry, current Entry, err error) error {
+		var value int64
+		if err == nil {
+			value, err = current.int64Value()
+		}
+		if err != nil && err != ErrNotFound {
 			return err
 		}
+		result = value + delta
+		e.value = encodeInt64(result)
 		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
+	return result, nil
+}
 
-	err = db.addNewBlockToDB()
-	if err != nil {
+func newValueEntry(key, value string, valueType byte) Entry {
+	return Entry{
+		key:       key,
+		value:     value,
+		valueType: valueType,
+	}
+}
+
+// Delete writes a tombstone for the key, so it is no longer returned by Get
+// and is dropped from the segments on the next merge.
+func (db *Db) Delete(key string) error {
+	if _, err := db.get(key); err != nil {
 		return err
 	}
 
-	err = db.blocks[len(db.blocks)-1].put(key, value)
+	return db.append(newTombstone(key))
+}
+
+func newTombstone(key string) Entry {
+	return Entry{
+		key:   key,
+		flags: flagTombstone,
+	}
+}
+
+func (db *Db) append(e Entry) error {
+	return db.appendIf(&e, nil)
+}
+
+// condition is checked by the block writer right before a conditional write.
+// It gets the current record for the key or the lookup error, and can change
+// the entry or cancel the write by returning an error.
+type condition func(e *Entry, current Entry, err error) error
+
+// appendIf writes the entry to the active block and sets its version. Appends
+// share the read lock, so concurrent writes can be synced together; rolling
+// over to a new segment takes the exclusive one.
+func (db *Db) appendIf(e *Entry, cond condition) error {
+	return db.write(writeArgument{entry: e}, cond)
+}
+
+// write appends the entry of the argument like appendIf, replicated entries
+// keep their versions and a raw record is copied as is.
+func (db *Db) write(arg writeArgument, cond condition) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	defer db.putLatency.since(time.Now())
+	e := arg.entry
+	if !e.isBatch() && arg.record == nil {
+		db.compress(e)
+	}
+
+	db.mu.RLock()
+	lastBlock := db.blocks[len(db.blocks)-1]
+	curSize, err := lastBlock.size()
+	if err == nil && curSize <= db.segmentSize {
+		arg.prepare = db.prepare(cond)
+		err = lastBlock.append(arg)
+		if err == nil {
+			db.afterWrite(e)
+		}
+		db.mu.RUnlock()
+		return err
+	}
+	db.mu.RUnlock()
 	if err != nil {
 		return err
 	}
 
-	if len(db.blocks) > 2 {
-		err = db.merge()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Another writer could have already started a new segment.
+	if db.blocks[len(db.blocks)-1] == lastBlock {
+		err = db.addNewBlockToDB()
 		if err != nil {
 			return err
 		}
+		if err := lastBlock.writeHint(); err != nil {
+			log.Printf("Segment %s: can't write hint: %s", lastBlock.outPath, err)
+		}
+		db.scheduleCompaction()
+	}
+	arg.prepare = db.prepare(cond)
+	err = db.blocks[len(db.blocks)-1].append(arg)
+	if err != nil {
+		return err
 	}
+	db.afterWrite(e)
 	return nil
 }
 
-func (db *Db) Get(key string) (string, error) {
+// prepare binds the condition to the current blocks. It must be called with
+// db.mu held, which keeps the blocks in place until the write is done.
+func (db *Db) prepare(cond condition) func(e *Entry) error {
+	if cond == nil {
+		return nil
+	}
+	blocks := db.blocks
+	return func(e *Entry) error {
+		current, err := db.lookup(blocks, e.key)
+		return cond(e, current, err)
+	}
+}
+
+// afterWrite updates the ordered index and the read cache with the keys written by the entry.
+func (db *Db) afterWrite(e *Entry) {
+	if !e.isBatch() {
+		db.keyWritten(e)
+		return
+	}
+	e.batchEntries(func(inner *Entry, _, _ int64) {
+		db.keyWritten(inner)
+	})
+}
+
+func (db *Db) keyWritten(e *Entry) {
+	if !e.isTombstone() {
+		db.ordered.insert(e.key)
+	}
+	if db.cache != nil {
+		db.cache.invalidate(e.key)
+	}
+}
+
+// buildKeyIndex collects the live keys of all blocks. It must be called with db.mu held.
+func (db *Db) buildKeyIndex() *skipList {
+	keys := newSkipList()
+	seen := make(map[string]struct{})
 	for j := len(db.blocks) - 1; j >= 0; j-- {
-		val, err := db.blocks[j].get(key)
-		if err != nil && err != ErrNotFound {
-			return "", err
-		}
-		if val != "" {
-			return val, nil
+		b := db.blocks[j]
+		b.rwmu.RLock()
+		for key := range b.index {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			if _, deleted := b.deleted[key]; !deleted {
+				keys.insert(key)
+			}
 		}
+		b.rwmu.RUnlock()
 	}
-	return "", ErrNotFound
+	return keys
+}
+
+func (db *Db) keys() *skipList {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.ordered
 }
 
-func (db *Db) merge() error {
-	tempBlock, err := mergeAll(db.blocks[:len(db.blocks)-1])
+// Get returns the value as a string. Integer values are formatted in base 10.
+func (db *Db) Get(key string) (string, error) {
+	e, err := db.get(key)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return e.stringValue()
+}
 
-	db.blocks = append(db.blocks[:1], db.blocks[:]...)
-	db.blocks[0] = tempBlock
+func (db *Db) GetInt64(key string) (int64, error) {
+	e, err := db.get(key)
+	if err != nil {
+		return 0, err
+	}
+	return e.int64Value()
+}
 
-	for _, block := range db.blocks[1 : len(db.blocks)-1] {
-		err := block.delete()
-		if err != nil {
-			return err
-		}
+func (db *Db) GetBytes(key string) ([]byte, error) {
+	e, err := db.get(key)
+	if err != nil {
+		return nil, err
 	}
+	if e.valueType != typeBytes {
+		return nil, ErrWrongType
+	}
+	return []byte(e.value), nil
+}
 
-	db.blocks = append(db.blocks[:1], db.blocks[len(db.blocks)-1])
-	err = os.Rename(tempBlock.segment.Name(), filepath.Join(db.dir, db.segmentName+"0"))
-	tempBlock.outPath = tempBlock.segment.Name()
+// GetValue returns the value with its stored type: string, int64 or []byte.
+func (db *Db) GetValue(key string) (interface{}, error) {
+	e, err := db.get(key)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
-}
\ No newline at end of file
+	return e.typedValue()
+}
+
+func (db *Db) get(key string) (Entry, error) {
+	defer db.getLatency.since(time.Now())
+	var generation uint64
+	if db.cache != nil {
+		e, gen, ok := db.cache.get(key)
+		if ok {
+			if e.expired(db.now()) {
+				return Entry{}, ErrNotFound
+			}
+			return e, nil
+		}
+		generation = gen
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	e, err := db.lookup(db.blocks, key)
+	if err == nil && db.cache != nil {
+		db.cache.add(e, generation)
+	}
+	return e, err
+}
+
+// lookup finds the newest live record for the key in the blocks.
+func (db *Db) lookup(blocks []*block, key string) (Entry, error) {
+	for j := len(blocks) - 1; j >= 0; j-- {
+		e, err := blocks[j].get(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err == errDeleted {
+			return Entry{}, ErrNotFound
+		}
+		if err != nil {
+			return Entry{}, err
+		}
+		if e.expired(db.now()) {
+			return Entry{}, ErrNotFound
+		}
+		if err := e.decompress(); err != nil {
+			return Entry{}, err
+		}
+		return e, nil
+	}
+	return Entry{}, ErrNotFound
+}
@@ -1,13 +1,19 @@
 package datastore
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 )
 
@@ -73,6 +79,7 @@ func TestDb_Put(t *testing.T) {
 	})
 
 	t.Run("new DB process", func(t *testing.T) {
+		db.Close()
 		db, err = NewDb(dir)
 		if err != nil {
 			t.Fatal(err)
@@ -99,7 +106,7 @@ func TestDb_Put(t *testing.T) {
 	}
 
 	t.Run("create new out file", func(t *testing.T) {
-		db.segmentSize = 600
+		db.segmentSize = 400
 		for _, pair := range pairs2 {
 			err := db.Put(pair[0], pair[1])
 			if err != nil {
@@ -116,7 +123,7 @@ func TestDb_Put(t *testing.T) {
 		if err != nil {
 			t.Fatalf("ERROR! Unexpected error: %v", err)
 		}
-		n := len(filesNames)
+		n := len(withoutHints(filesNames))
 		if n != 2 {
 			t.Errorf("ERROR!\nExpected: 2;\nGot: %v", n)
 		}
@@ -154,6 +161,10 @@ func TestDb_Put(t *testing.T) {
 			}
 		}
 
+		if err := db.compact(); err != nil {
+			t.Fatalf("ERROR! Unexpected error: %v", err)
+		}
+
 		files, err := os.Open(dir)
 		if err != nil {
 			t.Fatalf("ERROR! Unexpected error: %v", err)
@@ -163,7 +174,7 @@ func TestDb_Put(t *testing.T) {
 		if err != nil {
 			t.Fatalf("ERROR! Unexpected error: %v", err)
 		}
-		n := len(filesNames)
+		n := len(withoutHints(filesNames))
 		if n != 2 {
 			t.Errorf("ERROR!\nExpected: 2;\nGot: %v", n)
 		}
@@ -198,7 +209,7 @@ func TestDb_Checksum(t *testing.T) {
 	tmpFile.Close()
 
 	block := &block{
-		index:   map[string]int64{key: 0},
+		index:   hashIndex{key: {0, int64(len(encodedEntry))}},
 		outPath: tmpFile.Name(),
 	}
 
@@ -206,4 +217,795 @@ func TestDb_Checksum(t *testing.T) {
 	if err == nil {
 		t.Fatal("Expected error due to invalid checksum, but got none")
 	}
-}
\ No newline at end of file
+}
+func TestDb_Delete(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("delete in the same block", func(t *testing.T) {
+		if err := db.Put("key1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("key1"); err != nil {
+			t.Fatalf("ERROR! Can't delete key1: %s", err)
+		}
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		if err := db.Delete("key1"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	})
+
+	t.Run("delete shadows older blocks", func(t *testing.T) {
+		db.segmentSize = 100
+		if err := db.Put("key2", "value2"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; len(db.blocks) < 2; i++ {
+			if err := db.Put("filler"+strconv.Itoa(i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Delete("key2"); err != nil {
+			t.Fatalf("ERROR! Can't delete key2: %s", err)
+		}
+		if _, err := db.Get("key2"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	})
+
+	t.Run("new DB process", func(t *testing.T) {
+		db.Close()
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.segmentSize = 100
+		for _, key := range []string{"key1", "key2"} {
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Errorf("ERROR! %s\nExpected: %v;\nGot: %v", key, ErrNotFound, err)
+			}
+		}
+	})
+
+	t.Run("put after delete", func(t *testing.T) {
+		if err := db.Put("key1", "again"); err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Get("key1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "again" {
+			t.Errorf("ERROR!\nExpected: again;\nGot: %s", value)
+		}
+	})
+
+	t.Run("merge drops deleted keys", func(t *testing.T) {
+		if err := db.Delete("key1"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := db.Put("filler"+strconv.Itoa(i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"key1", "key2"} {
+			if _, ok := db.blocks[0].index[key]; ok {
+				t.Errorf("ERROR! %s is still present in the merged block", key)
+			}
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Errorf("ERROR! %s\nExpected: %v;\nGot: %v", key, ErrNotFound, err)
+			}
+		}
+	})
+}
+
+func TestDb_TypedValues(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PutInt64("counter", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutBytes("blob", []byte{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("name", "gods"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, db *Db) {
+		n, err := db.GetInt64("counter")
+		if err != nil || n != 42 {
+			t.Errorf("ERROR!\nExpected: 42;\nGot: %d (%v)", n, err)
+		}
+		s, err := db.Get("counter")
+		if err != nil || s != "42" {
+			t.Errorf("ERROR!\nExpected: 42;\nGot: %s (%v)", s, err)
+		}
+		b, err := db.GetBytes("blob")
+		if err != nil || !bytes.Equal(b, []byte{0, 1, 2}) {
+			t.Errorf("ERROR!\nExpected: [0 1 2];\nGot: %v (%v)", b, err)
+		}
+		v, err := db.GetValue("name")
+		if err != nil || v != "gods" {
+			t.Errorf("ERROR!\nExpected: gods;\nGot: %v (%v)", v, err)
+		}
+		if _, err := db.GetInt64("name"); err != ErrWrongType {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrWrongType, err)
+		}
+	}
+
+	t.Run("same process", func(t *testing.T) {
+		check(t, db)
+	})
+
+	t.Run("new DB process", func(t *testing.T) {
+		db.Close()
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+	})
+}
+
+func TestDb_Compaction(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 100
+	opts.Compaction = CompactionTrigger{}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put("key"+strconv.Itoa(i%5), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	segments := len(db.blocks)
+	if segments < 4 {
+		t.Fatalf("ERROR! Expected segments to pile up without a trigger, got %d", segments)
+	}
+
+	t.Run("size ratio", func(t *testing.T) {
+		db.SetCompactionPolicy(CompactionTrigger{SizeRatio: 1})
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		if len(db.blocks) != 2 {
+			t.Errorf("ERROR!\nExpected: 2;\nGot: %v", len(db.blocks))
+		}
+	})
+
+	t.Run("reads during compaction", func(t *testing.T) {
+		db.SetCompactionPolicy(CompactionTrigger{MaxSegments: 2})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 20; i < 60; i++ {
+				if err := db.Put("key"+strconv.Itoa(i%5), "value"+strconv.Itoa(i)); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			if _, err := db.Get("key" + strconv.Itoa(i%5)); err != nil {
+				t.Errorf("ERROR! Can't get during compaction: %s", err)
+			}
+		}
+		<-done
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 55; i < 60; i++ {
+			value, err := db.Get("key" + strconv.Itoa(i%5))
+			if err != nil || value != "value"+strconv.Itoa(i) {
+				t.Errorf("ERROR!\nExpected: value%d;\nGot: %s (%v)", i, value, err)
+			}
+		}
+	})
+}
+
+func TestDb_TornWrite(t *testing.T) {
+	prepare := func(t *testing.T) (string, string, int64) {
+		dir, err := os.MkdirTemp("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		valid := db.blocks[0].written()
+		if err := db.Put("key2", "value2"); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		return dir, db.blocks[0].outPath, valid
+	}
+
+	check := func(t *testing.T, dir, path string, valid, dropped int64) {
+		db, err := NewDb(dir)
+		if err != nil {
+			t.Fatalf("ERROR! Can't recover: %s", err)
+		}
+		defer db.Close()
+
+		if db.blocks[0].dropped != dropped {
+			t.Errorf("ERROR! Dropped bytes\nExpected: %d;\nGot: %d", dropped, db.blocks[0].dropped)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != valid {
+			t.Errorf("ERROR! Segment size\nExpected: %d;\nGot: %d", valid, info.Size())
+		}
+		if value, err := db.Get("key1"); err != nil || value != "value1" {
+			t.Errorf("ERROR!\nExpected: value1;\nGot: %s (%v)", value, err)
+		}
+		if _, err := db.Get("key2"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+
+		if err := db.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.Get("key3"); err != nil || value != "value3" {
+			t.Errorf("ERROR!\nExpected: value3;\nGot: %s (%v)", value, err)
+		}
+	}
+
+	t.Run("truncated tail", func(t *testing.T) {
+		dir, path, valid := prepare(t)
+		defer os.RemoveAll(dir)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(path, info.Size()-5); err != nil {
+			t.Fatal(err)
+		}
+		check(t, dir, path, valid, info.Size()-5-valid)
+	})
+
+	t.Run("garbage tail", func(t *testing.T) {
+		dir, path, valid := prepare(t)
+		defer os.RemoveAll(dir)
+
+		// Keep the length of the last record, but overwrite its contents.
+		f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		garbage := bytes.Repeat([]byte{0xAB}, 20)
+		if _, err := f.WriteAt(garbage, valid+4); err != nil {
+			t.Fatal(err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		check(t, dir, path, valid, info.Size()-valid)
+	})
+
+	t.Run("short header", func(t *testing.T) {
+		dir, path, valid := prepare(t)
+		defer os.RemoveAll(dir)
+
+		if err := os.Truncate(path, valid+2); err != nil {
+			t.Fatal(err)
+		}
+		check(t, dir, path, valid, 2)
+	})
+
+	t.Run("bad checksum", func(t *testing.T) {
+		dir, path, valid := prepare(t)
+		defer os.RemoveAll(dir)
+
+		// Change the version of the last record, it is covered only by the CRC.
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)-12]++
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		check(t, dir, path, valid, int64(len(data))-valid)
+	})
+
+	t.Run("zeroed tail", func(t *testing.T) {
+		dir, path, valid := prepare(t)
+		defer os.RemoveAll(dir)
+
+		// The file grew, but neither the last record nor the bytes after
+		// it reached the disk.
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zeros := make([]byte, info.Size()-valid+16)
+		if _, err := f.WriteAt(zeros, valid); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		check(t, dir, path, valid, int64(len(zeros)))
+	})
+
+	t.Run("short size header", func(t *testing.T) {
+		dir, path, valid := prepare(t)
+		defer os.RemoveAll(dir)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := make([]byte, info.Size()-valid)
+		binary.LittleEndian.PutUint32(header, 10|formatCRC)
+		if _, err := f.WriteAt(header, valid); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		check(t, dir, path, valid, int64(len(header)))
+	})
+
+	corrupted := func(t *testing.T, dir, path string) {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewDb(dir); !errors.Is(err, errCorrupted) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", errCorrupted, err)
+		}
+		if after, err := os.Stat(path); err != nil || after.Size() != info.Size() {
+			t.Errorf("ERROR! The damaged segment is changed: %v", err)
+		}
+	}
+
+	t.Run("damaged middle record", func(t *testing.T) {
+		dir, path, _ := prepare(t)
+		defer os.RemoveAll(dir)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The last byte of value1, key2 follows it.
+		data[bytes.Index(data, []byte("value1"))+5]++
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		corrupted(t, dir, path)
+
+		if _, err := RepairSegment(path); err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		if value, err := db.Get("key2"); err != nil || value != "value2" {
+			t.Errorf("ERROR!\nExpected: value2;\nGot: %s (%v)", value, err)
+		}
+	})
+
+	t.Run("zeroed middle header", func(t *testing.T) {
+		dir, path, _ := prepare(t)
+		defer os.RemoveAll(dir)
+
+		f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(make([]byte, 4), 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		corrupted(t, dir, path)
+	})
+
+	t.Run("torn sealed segment", func(t *testing.T) {
+		dir, path, valid := prepare(t)
+		defer os.RemoveAll(dir)
+
+		if err := os.Truncate(path, valid+2); err != nil {
+			t.Fatal(err)
+		}
+		next := filepath.Join(filepath.Dir(path), DefaultOptions().SegmentPrefix+"2")
+		if err := os.WriteFile(next, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		corrupted(t, dir, path)
+	})
+}
+
+func TestDb_LegacyRecords(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Compaction = CompactionTrigger{MaxSegments: 100}
+	var segment []byte
+	for _, e := range []Entry{{key: "key1", value: "old"}, {key: "key2", value: "value2"}, {key: "key1", flags: flagTombstone}} {
+		segment = append(segment, encodeLegacy(e)...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, opts.SegmentPrefix+"1"), segment, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	if err := db.Put("key1", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+		for key, want := range map[string]string{"key1": "new", "key2": "value2"} {
+			if value, err := db.Get(key); err != nil || value != want {
+				t.Errorf("ERROR!\nExpected: %s;\nGot: %s (%v)", want, value, err)
+			}
+		}
+	}
+
+	t.Run("mixed segment", func(t *testing.T) {
+		check(t)
+		db.Close()
+		db, err = NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+
+	t.Run("merge rewrites legacy records", func(t *testing.T) {
+		db.SetCompactionPolicy(CompactionTrigger{MaxSegments: 1})
+		db.mu.Lock()
+		if err := db.addNewBlockToDB(); err != nil {
+			t.Fatal(err)
+		}
+		db.mu.Unlock()
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		e, err := db.blocks[0].get("key2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.legacy {
+			t.Error("ERROR! The merged record is in the legacy format")
+		}
+	})
+}
+
+// withoutHints drops hint files and the lock file from the directory listing,
+// leaving the segments.
+func withoutHints(filesNames []string) []string {
+	var segments []string
+	for _, name := range filesNames {
+		if !strings.HasSuffix(name, hintSuffix) && name != lockName {
+			segments = append(segments, name)
+		}
+	}
+	return segments
+}
+
+// getOpenPerLookup reads the record the way block.get did before the read
+// handles were shared: a new file and two seeks for every lookup.
+func getOpenPerLookup(b *block, key string) (Entry, error) {
+	b.rwmu.RLock()
+	position := b.index[key].offset
+	b.rwmu.RUnlock()
+
+	file, err := os.Open(b.outPath)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(position, 0)
+	if err != nil {
+		return Entry{}, err
+	}
+	reader := bufio.NewReader(file)
+	header, err := reader.Peek(4)
+	if err != nil {
+		return Entry{}, err
+	}
+	size, _ := recordSize(header)
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return Entry{}, err
+	}
+	var e Entry
+	err = e.Decode(data)
+
+	_, seekErr := file.Seek(position, 0)
+	if err == nil {
+		err = seekErr
+	}
+	return e, err
+}
+
+func BenchmarkDb_Get(b *testing.B) {
+	dir, err := os.MkdirTemp("", "bench-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	const keys = 1000
+	for i := 0; i < keys; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), strings.Repeat("v", 100)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	active := db.blocks[len(db.blocks)-1]
+
+	lookups := map[string]func(key string) error{
+		"shared handle": func(key string) error {
+			_, err := db.Get(key)
+			return err
+		},
+		"open per lookup": func(key string) error {
+			_, err := getOpenPerLookup(active, key)
+			return err
+		},
+	}
+	for name, lookup := range lookups {
+		b.Run(name, func(b *testing.B) {
+			// Many concurrent readers, like the servers behind the balancer.
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if err := lookup("key" + strconv.Itoa(i%keys)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestDb_TTL(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 150
+	opts.CacheSize = 1024
+	// Merge only when the test asks for it.
+	opts.Compaction = CompactionTrigger{MaxSegments: 100}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	clock := time.Now()
+	db.now = func() time.Time { return clock }
+
+	if err := db.PutWithTTL("session", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("permanent", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("key", "value", 0); err == nil {
+		t.Error("ERROR! Expected an error for a zero ttl")
+	}
+
+	t.Run("before expiry", func(t *testing.T) {
+		value, err := db.Get("session")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "value" {
+			t.Errorf("ERROR!\nExpected: value;\nGot: %s", value)
+		}
+	})
+
+	t.Run("after expiry", func(t *testing.T) {
+		clock = clock.Add(time.Minute)
+		if _, err := db.Get("session"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		if err := db.Delete("session"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		if _, err := db.Get("permanent"); err != nil {
+			t.Errorf("ERROR! Permanent key is lost: %s", err)
+		}
+	})
+
+	t.Run("expired record shadows older blocks", func(t *testing.T) {
+		if err := db.Put("shadowed", "old"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; len(db.blocks) < 3; i++ {
+			if err := db.Put("filler"+strconv.Itoa(i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.PutWithTTL("shadowed", "new", time.Second); err != nil {
+			t.Fatal(err)
+		}
+		clock = clock.Add(time.Second)
+		if _, err := db.Get("shadowed"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	})
+
+	t.Run("merge drops expired keys", func(t *testing.T) {
+		for i := 0; len(db.blocks) < 4; i++ {
+			if err := db.Put("filler"+strconv.Itoa(i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.SetCompactionPolicy(CompactionTrigger{MaxSegments: 1})
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		merged := db.blocks[0]
+		for _, key := range []string{"session", "shadowed"} {
+			if _, ok := merged.index[key]; ok {
+				t.Errorf("ERROR! %s is still present in the merged block", key)
+			}
+		}
+		if _, ok := merged.index["permanent"]; !ok {
+			t.Error("ERROR! permanent is missing in the merged block")
+		}
+	})
+}
+
+func TestDb_Increment(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	t.Run("missing key starts at zero", func(t *testing.T) {
+		value, err := db.Increment("counter", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != 5 {
+			t.Errorf("ERROR!\nExpected: 5;\nGot: %d", value)
+		}
+		value, err = db.Increment("counter", -2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := db.GetInt64("counter"); value != 3 || stored != 3 {
+			t.Errorf("ERROR!\nExpected: 3;\nGot: %d (stored %d)", value, stored)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		if err := db.Put("text", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Increment("text", 1); err != ErrWrongType {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrWrongType, err)
+		}
+		if value, _ := db.Get("text"); value != "value" {
+			t.Errorf("ERROR! The value is changed to %s", value)
+		}
+	})
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					if _, err := db.Increment("concurrent", 1); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		value, err := db.GetInt64("concurrent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != 500 {
+			t.Errorf("ERROR!\nExpected: 500;\nGot: %d", value)
+		}
+	})
+
+	t.Run("new DB process", func(t *testing.T) {
+		db.Close()
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Increment("counter", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != 4 {
+			t.Errorf("ERROR!\nExpected: 4;\nGot: %d", value)
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncMode defines when the segment writes are flushed to the disk with fsync.
+type SyncMode int
+
+const (
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncMode = iota
+	// SyncAlways acknowledges a write only after fsync. Writes that are
+	// waiting for the block writer at the same time share one fsync.
+	SyncAlways
+	// SyncInterval groups writes and acknowledges them after the fsync that
+	// runs every Durability.Interval.
+	SyncInterval
+)
+
+var syncModeNames = map[SyncMode]string{
+	SyncNever:    "never",
+	SyncAlways:   "always",
+	SyncInterval: "interval",
+}
+
+func (m SyncMode) String() string {
+	if name, ok := syncModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("SyncMode(%d)", int(m))
+}
+
+func ParseSyncMode(name string) (SyncMode, error) {
+	for mode, modeName := range syncModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return SyncNever, fmt.Errorf("unknown sync mode %q", name)
+}
+
+type Durability struct {
+	Mode     SyncMode
+	Interval time.Duration
+}
+
+func (d Durability) validate() error {
+	if d.Mode == SyncInterval && d.Interval <= 0 {
+		return fmt.Errorf("sync interval must be positive, got %v", d.Interval)
+	}
+	if _, ok := syncModeNames[d.Mode]; !ok {
+		return fmt.Errorf("unknown sync mode %v", d.Mode)
+	}
+	return nil
+}
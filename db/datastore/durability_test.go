@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDb_Durability(t *testing.T) {
+	modes := []Durability{
+		{Mode: SyncNever},
+		{Mode: SyncAlways},
+		{Mode: SyncInterval, Interval: 5 * time.Millisecond},
+	}
+	for _, durability := range modes {
+		t.Run(durability.Mode.String(), func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opts := DefaultOptions()
+			opts.Durability = durability
+			db, err := NewDbWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					key := "key" + strconv.Itoa(i)
+					if err := db.Put(key, "value"+strconv.Itoa(i)); err != nil {
+						t.Errorf("ERROR! Can't put %s: %s", key, err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			db.Close()
+
+			db, err = NewDb(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < 20; i++ {
+				value, err := db.Get("key" + strconv.Itoa(i))
+				if err != nil || value != "value"+strconv.Itoa(i) {
+					t.Errorf("ERROR!\nExpected: value%d;\nGot: %s (%v)", i, value, err)
+				}
+			}
+		})
+	}
+
+	t.Run("invalid interval", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.Durability = Durability{Mode: SyncInterval}
+		_, err := NewDbWithOptions(os.TempDir(), opts)
+		if err == nil {
+			t.Error("Expected error for a zero sync interval")
+		}
+	})
+}
+
+func TestParseSyncMode(t *testing.T) {
+	for _, mode := range []SyncMode{SyncNever, SyncAlways, SyncInterval} {
+		parsed, err := ParseSyncMode(mode.String())
+		if err != nil || parsed != mode {
+			t.Errorf("Got bad mode %v for %s (%v)", parsed, mode, err)
+		}
+	}
+	if _, err := ParseSyncMode("sometimes"); err == nil {
+		t.Error("Expected error for an unknown mode")
+	}
+}
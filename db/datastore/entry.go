@@ -1,93 +1,274 @@
 package datastore
 
 import (
-	"bufio"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"time"
 )
 
+// Records are written in the CRC format:
+//
+//	[size|formatCRC u32][kl u32][key][vl u32][value][flags][valueType][expiresAt i64][version u64][crc u32]
+//
+// The CRC32C covers all the bytes before it. Records of the legacy format have
+// no marker in the size and a hex-encoded SHA-1 of the key and value after
+// the value, followed by the fields that were added over time.
+const (
+	// formatCRC is the high bit of the record size, legacy sizes never reach it.
+	formatCRC uint32 = 1 << 31
+	// crcTrailerSize is the size of the fields after the value in the CRC format.
+	crcTrailerSize = 22
+	// minRecordSize is the size of the smallest CRC format record.
+	minRecordSize = 12 + crcTrailerSize
+
+	// checksumSize is the length of a hex-encoded SHA-1 checksum.
+	checksumSize = 40
+	// minLegacyRecordSize is the size of the smallest legacy record: lengths and the checksum.
+	minLegacyRecordSize = 12 + checksumSize
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Entry flags stored in the byte that follows the value.
+const (
+	flagTombstone byte = 1 << iota
+	flagBatch
+	flagCompressed // the value is gzipped, the checksum covers the compressed bytes
+)
+
+// Value types stored in the byte that follows the flags.
+const (
+	typeString byte = iota
+	typeInt64
+	typeBytes
+)
+
+var ErrWrongType = fmt.Errorf("record has a different value type")
+
+var errCorrupted = fmt.Errorf("corrupted file")
+
 type Entry struct {
-	key, value, checksum string
+	key, value       string
+	flags, valueType byte
+	expiresAt        int64  // unix nanoseconds, zero for records that never expire
+	version          uint64 // assigned in the write order, zero for records written before versions
+
+	// checksum is the SHA-1 of a legacy record, it is checked by valid.
+	checksum string
+	legacy   bool
+	// badCRC is set by Decode for a CRC format record that fails its checksum.
+	badCRC bool
+	// body holds the value of an entry written by PutReader instead of value.
+	body *valueBody
 }
 
+// Encode writes the entry in the CRC format.
 func (e *Entry) Encode() []byte {
 	kl := len(e.key)
 	vl := len(e.value)
-	cl := len(e.checksum)
-	size := kl + vl + cl + 12
+	size := kl + vl + 12 + crcTrailerSize
 	res := make([]byte, size)
-	binary.LittleEndian.PutUint32(res, uint32(size))
+	binary.LittleEndian.PutUint32(res, uint32(size)|formatCRC)
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
 	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
 	copy(res[kl+12:], e.value)
-	copy(res[kl+12+vl:], e.checksum)
+	e.encodeTrailer(res[size-crcTrailerSize:])
+	binary.LittleEndian.PutUint32(res[size-4:], crc32.Checksum(res[:size-4], crcTable))
 	return res
 }
 
-func (e *Entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
+// encodeTrailer writes the fields after the value, except for the CRC.
+func (e *Entry) encodeTrailer(tail []byte) {
+	tail[0] = e.flags
+	tail[1] = e.valueType
+	binary.LittleEndian.PutUint64(tail[2:], uint64(e.expiresAt))
+	binary.LittleEndian.PutUint64(tail[10:], e.version)
+}
+
+func (e *Entry) decodeTrailer(tail []byte) {
+	e.flags = tail[0]
+	e.valueType = tail[1]
+	e.expiresAt = int64(binary.LittleEndian.Uint64(tail[2:]))
+	e.version = binary.LittleEndian.Uint64(tail[10:])
+	e.checksum, e.legacy = "", false
+}
+
+// legacyRecord reports whether the record starting with the header is in the legacy format.
+func legacyRecord(header []byte) bool {
+	return binary.LittleEndian.Uint32(header)&formatCRC == 0
+}
+
+// recordSize returns the size of the record starting with the header and
+// whether the size is large enough for a record of its format.
+func recordSize(header []byte) (int64, bool) {
+	size := binary.LittleEndian.Uint32(header)
+	if size&formatCRC != 0 {
+		size &^= formatCRC
+		return int64(size), size >= minRecordSize
+	}
+	return int64(size), size >= minLegacyRecordSize
+}
+
+func (e *Entry) Decode(input []byte) error {
+	if len(input) < 8 {
+		return errCorrupted
+	}
+	if legacyRecord(input) {
+		return e.decodeLegacy(input)
+	}
+
+	size, ok := recordSize(input)
+	if !ok || size != int64(len(input)) {
+		return errCorrupted
+	}
+	kl := int(binary.LittleEndian.Uint32(input[4:]))
+	if kl > len(input)-minRecordSize {
+		return errCorrupted
+	}
+	vl := int(binary.LittleEndian.Uint32(input[kl+8:]))
+	if vl != len(input)-minRecordSize-kl {
+		return errCorrupted
+	}
+	e.key = string(input[8 : kl+8])
+	e.value = string(input[kl+12 : kl+12+vl])
+
+	tail := input[kl+12+vl:]
+	e.decodeTrailer(tail)
+	e.badCRC = binary.LittleEndian.Uint32(tail[18:]) != crc32.Checksum(input[:len(input)-4], crcTable)
+	return nil
+}
+
+func (e *Entry) decodeLegacy(input []byte) error {
+	kl := int(binary.LittleEndian.Uint32(input[4:]))
+	if kl > len(input)-12 {
+		return errCorrupted
+	}
 	keyBuf := make([]byte, kl)
 	copy(keyBuf, input[8:kl+8])
 	e.key = string(keyBuf)
 
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
+	vl := int(binary.LittleEndian.Uint32(input[kl+8:]))
+	if vl > len(input)-kl-12 {
+		return errCorrupted
+	}
 	valBuf := make([]byte, vl)
 	copy(valBuf, input[kl+12:kl+12+vl])
 	e.value = string(valBuf)
 
-	e.checksum = string(input[kl+12+vl:])
+	// Older records end right after the checksum, the flags, the value type
+	// or the expiry, their values are unversioned strings that never expire.
+	tail := input[kl+12+vl:]
+	e.flags, e.valueType, e.expiresAt, e.version = 0, typeString, 0, 0
+	if len(tail) > checksumSize {
+		e.checksum = string(tail[:checksumSize])
+		e.flags = tail[checksumSize]
+		if len(tail) > checksumSize+1 {
+			e.valueType = tail[checksumSize+1]
+		}
+		if len(tail) >= checksumSize+10 {
+			e.expiresAt = int64(binary.LittleEndian.Uint64(tail[checksumSize+2:]))
+		}
+		if len(tail) >= checksumSize+18 {
+			e.version = binary.LittleEndian.Uint64(tail[checksumSize+10:])
+		}
+	} else {
+		e.checksum = string(tail)
+	}
+	e.legacy, e.badCRC = true, false
+	return nil
 }
 
+// valid reports whether the stored checksum matches the record contents.
+// Entries which are not decoded from a record are always valid.
+func (e *Entry) valid() bool {
+	if e.legacy {
+		return e.checksum == calculateChecksum(e.key+e.value)
+	}
+	return !e.badCRC
+}
 
-func readValue(in *bufio.Reader) (string, string, error) {
-	// Зчитування заголовка для визначення розміру ключа
-	header, err := in.Peek(8)
-	if err != nil {
-		return "", "", err
+func (e *Entry) isTombstone() bool {
+	return e.flags&flagTombstone != 0
+}
+
+// expired reports whether the record has a TTL which ended before now.
+func (e *Entry) expired(now time.Time) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now.UnixNano()
+}
+
+// typedValue converts the stored value according to the entry value type.
+func (e *Entry) typedValue() (interface{}, error) {
+	switch e.valueType {
+	case typeString:
+		return e.value, nil
+	case typeInt64:
+		return e.int64Value()
+	case typeBytes:
+		return []byte(e.value), nil
+	default:
+		return nil, fmt.Errorf("unknown value type %d", e.valueType)
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
-	if err != nil {
-		return "", "", err
+}
+
+// stringValue formats integer values in base 10 and returns the others as they are stored.
+func (e *Entry) stringValue() (string, error) {
+	if e.valueType == typeInt64 {
+		value, err := e.int64Value()
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(value, 10), nil
 	}
+	return e.value, nil
+}
 
-	// Зчитування заголовка для визначення розміру значення
-	header, err = in.Peek(4)
-	if err != nil {
-		return "", "", err
+func (e *Entry) int64Value() (int64, error) {
+	if e.valueType != typeInt64 {
+		return 0, ErrWrongType
 	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
-	if err != nil {
-		return "", "", err
+	if len(e.value) != 8 {
+		return 0, errCorrupted
 	}
+	return int64(binary.LittleEndian.Uint64([]byte(e.value))), nil
+}
 
-	// Зчитування значення
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
+func encodeInt64(value int64) string {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(value))
+	return string(buf)
+}
+
+// readEntry reads a whole record starting at the offset.
+func readEntry(in io.ReaderAt, offset int64) (Entry, error) {
+	var e Entry
+	data, err := readRecord(in, offset)
 	if err != nil {
-		return "", "", err
-	}
-	if n != valSize {
-		return "", "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+		return e, err
 	}
-	value := string(data)
+	err = e.Decode(data)
+	return e, err
+}
 
-	// Зчитування контрольної суми
-	checksumSize := 40 // Розмір SHA-1 контрольної суми у вигляді рядка (40 символів)
-	checksumData := make([]byte, checksumSize)
-	n, err = in.Read(checksumData)
+// readRecord reads the encoded record starting at the offset.
+func readRecord(in io.ReaderAt, offset int64) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := in.ReadAt(header, offset)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
-	if n != checksumSize {
-		return "", "", fmt.Errorf("can't read checksum bytes (read %d, expected %d)", n, checksumSize)
+	size, ok := recordSize(header)
+	if !ok {
+		return nil, errCorrupted
 	}
-	checksum := string(checksumData)
 
-	return value, checksum, nil
+	data := make([]byte, size)
+	n, err := in.ReadAt(data, offset)
+	if err != nil {
+		return nil, fmt.Errorf("can't read record bytes (read %d, expected %d): %w", n, size, err)
+	}
+	return data, nil
 }
-
-
-
@@ -1,13 +1,14 @@
 package datastore
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/binary"
 	"testing"
+	"time"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := Entry{"key", "value", calculateChecksum("key+value")}
+	e := Entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -17,18 +18,166 @@ func TestEntry_Encode(t *testing.T) {
 	}
 }
 
-func TestReadValue(t *testing.T) {
-	ch := calculateChecksum("test-value")
-	e := Entry{"key", "test-value", ch}
+// encodeLegacy writes the entry in the SHA-1 format used before CRC records.
+func encodeLegacy(e Entry) []byte {
+	kl := len(e.key)
+	vl := len(e.value)
+	size := kl + vl + checksumSize + 30
+	res := make([]byte, size)
+	binary.LittleEndian.PutUint32(res, uint32(size))
+	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
+	copy(res[8:], e.key)
+	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
+	copy(res[kl+12:], e.value)
+	copy(res[kl+12+vl:], calculateChecksum(e.key+e.value))
+	res[size-18] = e.flags
+	res[size-17] = e.valueType
+	binary.LittleEndian.PutUint64(res[size-16:], uint64(e.expiresAt))
+	binary.LittleEndian.PutUint64(res[size-8:], e.version)
+	return res
+}
+
+func TestReadEntry(t *testing.T) {
+	e := Entry{key: "key", value: "test-value"}
 	data := e.Encode()
-	v, chRead, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	read, err := readEntry(bytes.NewReader(data), 0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if v != "test-value" {
-		t.Errorf("Got bad value [%s]", v)
+	if read.value != "test-value" {
+		t.Errorf("Got bad value [%s]", read.value)
+	}
+	if !read.valid() {
+		t.Error("Got bad checksum")
+	}
+}
+
+func TestEntry_Checksum(t *testing.T) {
+	e := Entry{key: "ab", value: "c", version: 7}
+	for name, data := range map[string][]byte{"crc": e.Encode(), "legacy": encodeLegacy(e)} {
+		t.Run(name, func(t *testing.T) {
+			var decoded Entry
+			if err := decoded.Decode(data); err != nil {
+				t.Fatal(err)
+			}
+			if !decoded.valid() || decoded.key != "ab" || decoded.value != "c" || decoded.version != 7 {
+				t.Errorf("Got bad entry %+v", decoded)
+			}
+			// The key length change is caught only by the CRC.
+			moved := append([]byte(nil), data...)
+			binary.LittleEndian.PutUint32(moved[4:], 1)
+			binary.LittleEndian.PutUint32(moved[9:], 2)
+			copy(moved[13:], "bc")
+			if decoded.Decode(moved) != nil || decoded.valid() != (name == "legacy") {
+				t.Errorf("Got bad checksum status %v for %q+%q", decoded.valid(), decoded.key, decoded.value)
+			}
+		})
 	}
-	if ch != chRead {
-		t.Errorf("Got bad checksum [%s]", ch)
+
+	data := e.Encode()
+	data[len(data)-13]++
+	var decoded Entry
+	if decoded.Decode(data) != nil || decoded.valid() {
+		t.Error("Expected a bad checksum for a changed trailer")
+	}
+}
+
+func TestEntry_ValueType(t *testing.T) {
+	e := Entry{key: "key", value: encodeInt64(-42), valueType: typeInt64}
+	var decoded Entry
+	decoded.Decode(e.Encode())
+	value, err := decoded.typedValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != int64(-42) {
+		t.Errorf("Got bad value [%v]", value)
+	}
+
+	// Records written before value types were introduced hold strings.
+	legacy := encodeLegacy(Entry{key: "key", value: "value"})
+	legacy = legacy[:len(legacy)-17]
+	binary.LittleEndian.PutUint32(legacy, uint32(len(legacy)))
+	decoded = Entry{valueType: typeBytes}
+	decoded.Decode(legacy)
+	value, err = decoded.typedValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" {
+		t.Errorf("Got bad value [%v]", value)
+	}
+}
+
+func TestEntry_DecodeCorrupted(t *testing.T) {
+	e := Entry{key: "key", value: "value"}
+	data := e.Encode()
+	binary.LittleEndian.PutUint32(data[4:], 1000)
+	if err := e.Decode(data); err == nil {
+		t.Error("Expected error for a key longer than the record")
+	}
+}
+
+func TestEntry_Tombstone(t *testing.T) {
+	e := Entry{key: "key", flags: flagTombstone}
+	var decoded Entry
+	decoded.Decode(e.Encode())
+	if !decoded.isTombstone() {
+		t.Error("tombstone flag is lost")
+	}
+	if !decoded.valid() {
+		t.Error("Got bad checksum")
+	}
+
+	// Records written without the flags byte are regular values.
+	legacy := encodeLegacy(e)
+	legacy = legacy[:len(legacy)-18]
+	binary.LittleEndian.PutUint32(legacy, uint32(len(legacy)))
+	decoded.Decode(legacy)
+	if decoded.isTombstone() || !decoded.valid() {
+		t.Error("legacy record is decoded incorrectly")
+	}
+}
+
+func TestEntry_Expiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	e := Entry{key: "key", value: "value", expiresAt: now.UnixNano()}
+	var decoded Entry
+	decoded.Decode(e.Encode())
+	if decoded.expiresAt != e.expiresAt {
+		t.Errorf("Got bad expiry [%d]", decoded.expiresAt)
+	}
+	if decoded.expired(now.Add(-time.Second)) || !decoded.expired(now) {
+		t.Error("expiry is checked incorrectly")
+	}
+
+	// Records written without the expiry never expire.
+	legacy := encodeLegacy(e)
+	legacy = legacy[:len(legacy)-16]
+	binary.LittleEndian.PutUint32(legacy, uint32(len(legacy)))
+	decoded.Decode(legacy)
+	if decoded.expiresAt != 0 || decoded.expired(now) {
+		t.Error("legacy record is decoded incorrectly")
+	}
+	if decoded.valueType != typeString || !decoded.valid() {
+		t.Error("legacy record trailer is decoded incorrectly")
+	}
+}
+
+func TestEntry_Version(t *testing.T) {
+	e := Entry{key: "key", value: "value", version: 42}
+	var decoded Entry
+	decoded.Decode(e.Encode())
+	if decoded.version != 42 {
+		t.Errorf("Got bad version [%d]", decoded.version)
+	}
+
+	// Records written without the version have version 0.
+	legacy := encodeLegacy(e)
+	legacy = legacy[:len(legacy)-8]
+	binary.LittleEndian.PutUint32(legacy, uint32(len(legacy)))
+	decoded.Decode(legacy)
+	if decoded.version != 0 {
+		t.Errorf("Got bad legacy version [%d]", decoded.version)
 	}
 }
@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// A hint file stores the index of a sealed segment, so recovery does not have
+// to read the whole segment. Layout:
+//
+//	magic | segment size (8) | keys count (4) | max version (8) | keys... | crc32 of everything before (4)
+//
+// where every key is key length (4) | key | offset (8) | record size (4) | deleted (1).
+// Hints of an older format are ignored, so their segments are scanned.
+const hintSuffix = ".hint"
+
+var hintMagic = []byte("HNT3")
+
+var errBadHint = fmt.Errorf("bad hint file")
+
+func hintPath(segmentPath string) string {
+	return segmentPath + hintSuffix
+}
+
+// writeHint saves the index of a sealed block next to its segment.
+func (b *block) writeHint() error {
+	var buf bytes.Buffer
+	buf.Write(hintMagic)
+
+	b.rwmu.RLock()
+	binary.Write(&buf, binary.LittleEndian, uint64(b.outOffset))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(b.index)))
+	binary.Write(&buf, binary.LittleEndian, b.maxVersion)
+	for key, loc := range b.index {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(key)))
+		buf.WriteString(key)
+		binary.Write(&buf, binary.LittleEndian, uint64(loc.offset))
+		binary.Write(&buf, binary.LittleEndian, uint32(loc.size))
+		_, deleted := b.deleted[key]
+		if deleted {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	}
+	b.rwmu.RUnlock()
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	tempPath := hintPath(b.outPath) + tempSuffix
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, hintPath(b.outPath))
+}
+
+// loadHint fills the index from the hint file. It fails without touching the
+// index if the hint is missing, damaged or written for a segment of another size.
+func (b *block) loadHint(segmentSize int64) error {
+	data, err := os.ReadFile(hintPath(b.outPath))
+	if err != nil {
+		return err
+	}
+
+	headerSize := len(hintMagic) + 20
+	if len(data) < headerSize+4 || !bytes.Equal(data[:len(hintMagic)], hintMagic) {
+		return errBadHint
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return errBadHint
+	}
+	if int64(binary.LittleEndian.Uint64(body[len(hintMagic):])) != segmentSize {
+		return errBadHint
+	}
+
+	count := int(binary.LittleEndian.Uint32(body[len(hintMagic)+8:]))
+	maxVersion := binary.LittleEndian.Uint64(body[len(hintMagic)+12:])
+	index := make(hashIndex, count)
+	deleted := make(map[string]struct{})
+	pos := headerSize
+	for i := 0; i < count; i++ {
+		if len(body)-pos < 4 {
+			return errBadHint
+		}
+		kl := int(binary.LittleEndian.Uint32(body[pos:]))
+		pos += 4
+		if len(body)-pos < kl+13 {
+			return errBadHint
+		}
+		key := string(body[pos : pos+kl])
+		pos += kl
+		offset := int64(binary.LittleEndian.Uint64(body[pos:]))
+		size := int64(binary.LittleEndian.Uint32(body[pos+8:]))
+		if offset < 0 || size <= 0 || offset+size > segmentSize {
+			return errBadHint
+		}
+		index[key] = location{offset, size}
+		if body[pos+12] != 0 {
+			deleted[key] = struct{}{}
+		}
+		pos += 13
+	}
+	if pos != len(body) {
+		return errBadHint
+	}
+
+	b.index = index
+	b.deleted = deleted
+	b.maxVersion = maxVersion
+	b.outOffset = segmentSize
+	return nil
+}
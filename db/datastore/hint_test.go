@@ -0,0 +1,102 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDb_Hints(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 300
+	opts.Compaction = CompactionTrigger{}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+	firstSegment := db.blocks[0].outPath
+	db.Close()
+
+	if _, err := os.Stat(hintPath(firstSegment)); err != nil {
+		t.Fatalf("ERROR! No hint for the sealed segment: %s", err)
+	}
+
+	reopen := func(t *testing.T, hinted bool) {
+		db, err = NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if db.blocks[0].hinted != hinted {
+			t.Errorf("ERROR! Index loaded from the hint\nExpected: %v;\nGot: %v", hinted, db.blocks[0].hinted)
+		}
+		if db.blocks[len(db.blocks)-1].hinted {
+			t.Error("ERROR! The active segment must be scanned")
+		}
+		for i := 0; i < 10; i++ {
+			value, err := db.Get("key" + strconv.Itoa(i))
+			if i == 3 {
+				if err != ErrNotFound {
+					t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+				}
+				continue
+			}
+			if err != nil || value != "value"+strconv.Itoa(i) {
+				t.Errorf("ERROR!\nExpected: value%d;\nGot: %s (%v)", i, value, err)
+			}
+		}
+	}
+
+	t.Run("load hints", func(t *testing.T) {
+		reopen(t, true)
+	})
+
+	t.Run("damaged hint", func(t *testing.T) {
+		data, err := os.ReadFile(hintPath(firstSegment))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)/2] ^= 0xff
+		if err := os.WriteFile(hintPath(firstSegment), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		reopen(t, false)
+		// The hint is written again after the scan.
+		reopen(t, true)
+	})
+
+	t.Run("missing hint", func(t *testing.T) {
+		if err := os.Remove(hintPath(firstSegment)); err != nil {
+			t.Fatal(err)
+		}
+		reopen(t, false)
+		reopen(t, true)
+	})
+
+	t.Run("orphan hint", func(t *testing.T) {
+		orphan := hintPath(filepath.Join(dir, opts.SegmentPrefix+"99"))
+		if err := os.WriteFile(orphan, []byte("stale"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		reopen(t, true)
+		if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+			t.Errorf("ERROR! Orphan hint is not removed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,306 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The functions below work with the files of a database which is not open,
+// they are used by cmd/dbtool to look into a data directory NewDb rejects.
+
+// SegmentInfo describes a segment file found by ListSegments.
+type SegmentInfo struct {
+	Name   string
+	Number int
+	// Generation counts the merges that produced the segment under its number.
+	Generation int
+	Size       int64
+	// HasHint is set when the segment has a hint file, HintErr tells why the
+	// hint is ignored by recovery.
+	HasHint bool
+	HintErr error
+}
+
+// ListSegments returns the segments in the directory ordered by number and
+// the names of the other files, which make NewDb fail.
+func ListSegments(dir, prefix string) ([]SegmentInfo, []string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := segmentPattern(prefix)
+	hints := make(map[string]bool)
+	var segments []SegmentInfo
+	var other []string
+	for _, entry := range entries {
+		if (entry.IsDir() && entry.Name() == bucketsDir) || entry.Name() == lockName || entry.Name() == cursorName {
+			continue
+		}
+		match := r.FindStringSubmatch(entry.Name())
+		if match == nil {
+			other = append(other, entry.Name())
+			continue
+		}
+		if match[3] != "" {
+			hints[strings.TrimSuffix(entry.Name(), hintSuffix)] = true
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, nil, err
+		}
+		id, err := parseSegmentID(match)
+		if err != nil {
+			return nil, nil, err
+		}
+		segments = append(segments, SegmentInfo{Name: entry.Name(), Number: id.number, Generation: id.generation, Size: info.Size()})
+	}
+
+	for i := range segments {
+		s := &segments[i]
+		if !hints[s.Name] {
+			continue
+		}
+		delete(hints, s.Name)
+		s.HasHint = true
+		b := block{outPath: filepath.Join(dir, s.Name)}
+		s.HintErr = b.loadHint(s.Size)
+	}
+	// Hints of missing segments.
+	for name := range hints {
+		other = append(other, name+hintSuffix)
+	}
+	sort.Strings(other)
+	sort.Slice(segments, func(i, j int) bool {
+		return segmentID{segments[i].Number, segments[i].Generation}.less(segmentID{segments[j].Number, segments[j].Generation})
+	})
+	return segments, other, nil
+}
+
+// SegmentRecord is a record found by ScanSegment. The entries of a batch
+// follow the batch record with InBatch set.
+type SegmentRecord struct {
+	Offset int64
+	Size   int64
+	Key    string
+	// Value is decompressed, integers are formatted in base 10.
+	Value      string
+	Type       string
+	Tombstone  bool
+	Batch      bool
+	InBatch    bool
+	Compressed bool
+	// Legacy is set for records with a SHA-1 checksum instead of a CRC.
+	Legacy  bool
+	Version uint64
+	// ExpiresAt is zero for records without a TTL.
+	ExpiresAt time.Time
+	// Valid is false when the checksum does not match the record.
+	Valid bool
+	// Err is set for a record that can't be decoded, the scan stops at it.
+	Err error
+}
+
+// ScanSegment calls fn for every record of the segment file.
+func ScanSegment(path string, fn func(rec SegmentRecord) error) error {
+	return readSegment(path, func(offset, size int64, data []byte, e *Entry, err error) error {
+		if err != nil {
+			return fn(SegmentRecord{Offset: offset, Size: size, Err: err})
+		}
+		rec := newSegmentRecord(e, offset, size)
+		if err := fn(rec); err != nil {
+			return err
+		}
+		if !rec.Batch || !rec.Valid {
+			return nil
+		}
+
+		var inner []SegmentRecord
+		err = e.batchEntries(func(ie *Entry, innerOffset, size int64) {
+			r := newSegmentRecord(ie, offset+innerOffset, size)
+			r.InBatch = true
+			inner = append(inner, r)
+		})
+		if err != nil {
+			return fn(SegmentRecord{Offset: offset, Size: size, Batch: true, Err: err})
+		}
+		for _, r := range inner {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func newSegmentRecord(e *Entry, offset, size int64) SegmentRecord {
+	rec := SegmentRecord{
+		Offset:     offset,
+		Size:       size,
+		Key:        e.key,
+		Type:       typeName(e.valueType),
+		Tombstone:  e.isTombstone(),
+		Batch:      e.isBatch(),
+		Compressed: e.flags&flagCompressed != 0,
+		Legacy:     e.legacy,
+		Version:    e.version,
+		Valid:      e.valid(),
+	}
+	if e.expiresAt != 0 {
+		rec.ExpiresAt = time.Unix(0, e.expiresAt)
+	}
+	if rec.Valid && !rec.Batch {
+		plain := *e
+		if plain.decompress() != nil {
+			rec.Valid = false
+		} else if value, err := plain.stringValue(); err == nil {
+			rec.Value = value
+		}
+	}
+	return rec
+}
+
+func typeName(valueType byte) string {
+	switch valueType {
+	case typeString:
+		return "string"
+	case typeInt64:
+		return "int64"
+	case typeBytes:
+		return "bytes"
+	default:
+		return fmt.Sprintf("unknown(%d)", valueType)
+	}
+}
+
+// readSegment calls fn with every record of the segment. A record that can't
+// be read or decoded is passed with an error, no data and the size of the rest
+// of the file, it ends the segment.
+func readSegment(path string, fn func(offset, size int64, data []byte, e *Entry, err error) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	for offset := int64(0); offset < info.Size(); {
+		// Check the size before reading the record, a damaged header can
+		// claim up to 2 GiB.
+		header := make([]byte, 4)
+		_, err := f.ReadAt(header, offset)
+		if size, ok := recordSize(header); err == nil && (!ok || size > info.Size()-offset) {
+			err = errCorrupted
+		}
+		var (
+			e    Entry
+			data []byte
+		)
+		if err == nil {
+			data, err = readRecord(f, offset)
+		}
+		if err == nil {
+			err = e.Decode(data)
+		}
+		if err != nil {
+			return fn(offset, info.Size()-offset, nil, nil, err)
+		}
+		if err := fn(offset, int64(len(data)), data, &e, nil); err != nil {
+			return err
+		}
+		offset += int64(len(data))
+	}
+	return nil
+}
+
+// RepairStats tells what RepairSegment did with the records of a segment.
+type RepairStats struct {
+	Kept    int
+	Skipped int
+	// Truncated is the size of the tail that could not be decoded.
+	Truncated int64
+}
+
+// RepairSegment rewrites the segment without the records failing their
+// checksum and without the tail that can't be decoded, keeping the valid
+// records after a bad one. NewDb fails with a damaged segment until it is
+// repaired, only a torn tail of the active segment is truncated. The segment hint
+// is removed, it is written again by NewDb. The data directory must not be open,
+// ErrLocked is returned otherwise.
+func RepairSegment(path string) (RepairStats, error) {
+	var stats RepairStats
+	lock, err := lockDir(filepath.Dir(path), true)
+	if err != nil {
+		return stats, err
+	}
+	defer lock.Close()
+
+	var kept [][]byte
+	err = readSegment(path, func(offset, size int64, data []byte, e *Entry, err error) error {
+		switch {
+		case err != nil:
+			stats.Truncated = size
+		case !e.valid() || (e.isBatch() && e.batchEntries(func(*Entry, int64, int64) {}) != nil):
+			stats.Skipped++
+		default:
+			stats.Kept++
+			kept = append(kept, data)
+		}
+		return nil
+	})
+	if err != nil || (stats.Skipped == 0 && stats.Truncated == 0) {
+		return stats, err
+	}
+
+	tempPath := path + tempSuffix
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return stats, err
+	}
+	for _, data := range kept {
+		if _, err = f.Write(data); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Remove(hintPath(path))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return stats, err
+	}
+	return stats, os.Rename(tempPath, path)
+}
+
+// Compact merges all the segments of a database, which must not be open, and
+// starts a new empty active segment.
+func Compact(dir string, opts Options) error {
+	opts.Compaction = ManualCompaction{}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		return err
+	}
+
+	err = db.Compact()
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Compaction = CompactionTrigger{}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if err := db.Put(key, "value-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wb := new(WriteBatch)
+	wb.Put("key4", "value-key4")
+	wb.Delete("key1")
+	if err := db.Batch(wb); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segment := filepath.Join(dir, opts.SegmentPrefix+"1")
+	scan := func(t *testing.T) []SegmentRecord {
+		t.Helper()
+		var records []SegmentRecord
+		err := ScanSegment(segment, func(rec SegmentRecord) error {
+			records = append(records, rec)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return records
+	}
+
+	t.Run("list", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(dir, "stray"), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(filepath.Join(dir, "stray"))
+		segments, other, err := ListSegments(dir, opts.SegmentPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != 1 || segments[0].Number != 1 || segments[0].Size == 0 {
+			t.Errorf("ERROR! Unexpected segments %+v", segments)
+		}
+		if len(other) != 1 || other[0] != "stray" {
+			t.Errorf("ERROR!\nExpected: [stray];\nGot: %v", other)
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		records := scan(t)
+		if len(records) != 6 {
+			t.Fatalf("ERROR!\nExpected: 6 records;\nGot: %+v", records)
+		}
+		if records[1].Key != "key2" || records[1].Value != "value-key2" || !records[1].Valid || records[1].Version != 2 {
+			t.Errorf("ERROR! Unexpected record %+v", records[1])
+		}
+		if !records[3].Batch || records[3].Offset != records[2].Offset+records[2].Size {
+			t.Errorf("ERROR! Unexpected batch record %+v", records[3])
+		}
+		if !records[5].InBatch || records[5].Key != "key1" || !records[5].Tombstone {
+			t.Errorf("ERROR! Unexpected batch entry %+v", records[5])
+		}
+	})
+
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := scan(t)
+	// Damage the key of the second record and cut the batch short.
+	data[records[1].Offset+10]++
+	data = data[:len(data)-5]
+	if err := os.WriteFile(segment, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("scan damaged", func(t *testing.T) {
+		records := scan(t)
+		if len(records) != 4 {
+			t.Fatalf("ERROR!\nExpected: 4 records;\nGot: %+v", records)
+		}
+		if records[1].Valid || !records[2].Valid {
+			t.Errorf("ERROR! Unexpected checksum status %+v", records[:3])
+		}
+		if records[3].Err == nil || records[3].Offset != records[2].Offset+records[2].Size {
+			t.Errorf("ERROR! Unexpected tail %+v", records[3])
+		}
+	})
+
+	t.Run("scan garbage size", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), opts.SegmentPrefix+"1")
+		e := Entry{key: "key", value: "value"}
+		garbage := append(e.Encode(), 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0)
+		if err := os.WriteFile(path, garbage, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		var records []SegmentRecord
+		err := ScanSegment(path, func(rec SegmentRecord) error {
+			records = append(records, rec)
+			return nil
+		})
+		runtime.ReadMemStats(&after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 2 || records[1].Err == nil || records[1].Size != 8 {
+			t.Errorf("ERROR! Unexpected records %+v", records)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("ERROR! Allocated %d bytes for the damaged size", allocated)
+		}
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		stats, err := RepairSegment(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Kept != 2 || stats.Skipped != 1 || stats.Truncated != records[3].Size-5 {
+			t.Errorf("ERROR! Unexpected repair stats %+v", stats)
+		}
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if value, err := db.Get("key3"); err != nil || value != "value-key3" {
+			t.Errorf("ERROR!\nExpected: value-key3;\nGot: %s (%v)", value, err)
+		}
+		if _, err := db.Get("key2"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			db.Put("key1", "overwritten")
+			db.mu.Lock()
+			db.addNewBlockToDB()
+			db.mu.Unlock()
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := Compact(dir, opts); err != nil {
+			t.Fatal(err)
+		}
+		segments, _, err := ListSegments(dir, opts.SegmentPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != 2 || segments[1].Size != 0 {
+			t.Errorf("ERROR! Unexpected segments %+v", segments)
+		}
+		db, err = NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for key, want := range map[string]string{"key1": "overwritten", "key3": "value-key3"} {
+			if value, err := db.Get(key); err != nil || value != want {
+				t.Errorf("ERROR!\nExpected: %s;\nGot: %s (%v)", want, value, err)
+			}
+		}
+	})
+}
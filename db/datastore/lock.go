@@ -0,0 +1,39 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockName is the lock file of the data directory. A database opened for
+// writing holds an exclusive lock on it and read-only ones hold shared locks,
+// so a directory is never written by two processes or changed under a reader.
+// Readers create the file too, a directory without it, like a restored
+// snapshot, is locked all the same.
+const lockName = "LOCK"
+
+var ErrLocked = fmt.Errorf("data directory is locked by another process")
+
+// lockDir takes the lock of the data directory without waiting, creating
+// the lock file if needed. Closing the file releases the lock.
+func lockDir(dir string, exclusive bool) (*os.File, error) {
+	flag := os.O_RDONLY
+	if exclusive {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(filepath.Join(dir, lockName), flag|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("can't create the lock file: %w", err)
+	}
+
+	held, err := lockFile(f, exclusive)
+	if err == nil && held {
+		err = fmt.Errorf("%w: %s", ErrLocked, dir)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
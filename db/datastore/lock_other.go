@@ -0,0 +1,11 @@
+//go:build !unix
+
+package datastore
+
+import "os"
+
+// lockFile does not lock anything on this platform, the data directory must
+// not be shared by processes.
+func lockFile(f *os.File, exclusive bool) (bool, error) {
+	return false, nil
+}
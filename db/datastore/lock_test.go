@@ -0,0 +1,111 @@
+//go:build unix
+
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_Lock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("writer", func(t *testing.T) {
+		if _, err := NewDb(dir); !errors.Is(err, ErrLocked) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrLocked, err)
+		}
+		if _, err := OpenReadOnly(dir); !errors.Is(err, ErrLocked) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrLocked, err)
+		}
+		if _, err := RepairSegment(db.blocks[0].outPath); !errors.Is(err, ErrLocked) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrLocked, err)
+		}
+	})
+
+	t.Run("readers", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		first, err := OpenReadOnly(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := OpenReadOnly(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewDb(dir); !errors.Is(err, ErrLocked) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrLocked, err)
+		}
+		first.Close()
+		second.Close()
+	})
+
+	t.Run("released", func(t *testing.T) {
+		db, err := NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if value, err := db.Get("key"); err != nil || value != "value" {
+			t.Errorf("ERROR!\nExpected: value;\nGot: %s (%v)", value, err)
+		}
+	})
+
+	t.Run("restored snapshot", func(t *testing.T) {
+		snapshotDir, restoredDir := filepath.Join(dir, "snapshot"), filepath.Join(dir, "restored")
+		db, err := NewDb(filepath.Join(dir, "source"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		err = db.Snapshot(snapshotDir)
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Restore(snapshotDir, restoredDir); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := OpenReadOnly(restoredDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		if _, err := NewDb(restoredDir); !errors.Is(err, ErrLocked) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrLocked, err)
+		}
+	})
+
+	t.Run("buckets", func(t *testing.T) {
+		other := filepath.Join(dir, "other")
+		db, err := NewDb(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.CreateBucket("teams"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewDb(filepath.Join(other, bucketsDir, "teams")); !errors.Is(err, ErrLocked) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrLocked, err)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms in seconds.
+var latencyBuckets = [...]float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// histogram counts the latencies in latencyBuckets, the last counter is for
+// the ones above all the bounds.
+type histogram struct {
+	counts [len(latencyBuckets) + 1]atomic.Uint64
+	sum    atomic.Int64 // nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.counts[sort.SearchFloat64s(latencyBuckets[:], d.Seconds())].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// since observes the time passed since the start.
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+// Histogram is a latency distribution in the Prometheus layout: the bucket
+// counts are cumulative and the last bucket is +Inf, which equals Count.
+type Histogram struct {
+	Buckets []Bucket `json:"buckets"`
+	Count   uint64   `json:"count"`
+	// Sum is the total of the observed latencies in seconds.
+	Sum float64 `json:"sum"`
+}
+
+// Bucket counts the latencies up to UpperBound seconds.
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"`
+}
+
+func (h *histogram) snapshot() Histogram {
+	var res Histogram
+	for i, bound := range latencyBuckets {
+		res.Count += h.counts[i].Load()
+		res.Buckets = append(res.Buckets, Bucket{bound, res.Count})
+	}
+	res.Count += h.counts[len(latencyBuckets)].Load()
+	res.Sum = time.Duration(h.sum.Load()).Seconds()
+	return res
+}
+
+// MergeStats describes the merges done since the database was opened.
+type MergeStats struct {
+	Count        uint64  `json:"count"`
+	Failed       uint64  `json:"failed"`
+	TotalSeconds float64 `json:"totalSeconds"`
+	LastSeconds  float64 `json:"lastSeconds"`
+}
+
+type mergeCounters struct {
+	count, failed   atomic.Uint64
+	total, lastTime atomic.Int64 // nanoseconds
+}
+
+func (c *mergeCounters) done(start time.Time, err error) {
+	if err != nil {
+		c.failed.Add(1)
+		return
+	}
+	d := int64(time.Since(start))
+	c.count.Add(1)
+	c.total.Add(d)
+	c.lastTime.Store(d)
+}
+
+func (c *mergeCounters) snapshot() MergeStats {
+	return MergeStats{
+		Count:        c.count.Load(),
+		Failed:       c.failed.Load(),
+		TotalSeconds: time.Duration(c.total.Load()).Seconds(),
+		LastSeconds:  time.Duration(c.lastTime.Load()).Seconds(),
+	}
+}
@@ -0,0 +1,56 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Options configure a database opened with NewDbWithOptions. Start from
+// DefaultOptions and override the fields that need tuning.
+type Options struct {
+	// SegmentSize is the size in bytes after which the active segment is sealed
+	// and a new one is started.
+	SegmentSize int64
+	// SegmentPrefix is the segment file name before the segment number.
+	SegmentPrefix string
+	// Compaction decides when the sealed segments are merged. Nil disables
+	// background compaction.
+	Compaction CompactionPolicy
+	Durability Durability
+	// CacheSize limits the keys and values kept by the read cache, in bytes.
+	// Zero disables the cache.
+	CacheSize int64
+	// Compression gzips the values of at least compressMinSize bytes when
+	// it makes them smaller. Segments may mix compressed and plain records.
+	Compression bool
+	// KeepTombstones keeps the deleted and expired records in all merges, so
+	// a follower lagging behind a merge still replicates them. A db keeps them
+	// anyway after serving Changes, the option covers a primary restarted
+	// before its followers come back.
+	KeepTombstones bool
+}
+
+func DefaultOptions() Options {
+	return Options{
+		SegmentSize:   10000000,
+		SegmentPrefix: "segment-data-",
+		Compaction:    CompactionTrigger{MaxSegments: 2},
+		Durability:    Durability{Mode: SyncNever},
+	}
+}
+
+func (o Options) validate() error {
+	if o.SegmentSize <= 0 {
+		return fmt.Errorf("segment size must be positive, got %d", o.SegmentSize)
+	}
+	if o.SegmentPrefix == "" || strings.ContainsAny(o.SegmentPrefix, `/\`) {
+		return fmt.Errorf("invalid segment prefix %q", o.SegmentPrefix)
+	}
+	if err := validatePolicy(o.Compaction); err != nil {
+		return err
+	}
+	if o.CacheSize < 0 {
+		return fmt.Errorf("cache size must not be negative, got %d", o.CacheSize)
+	}
+	return o.Durability.validate()
+}
@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestNewDbWithOptions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	small := DefaultOptions()
+	small.SegmentSize = 100
+	small.SegmentPrefix = "small-"
+	small.Compaction = CompactionTrigger{}
+	smallDb, err := NewDbWithOptions(filepath.Join(dir, "small"), small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { smallDb.Close() }()
+
+	bigDb, err := NewDbWithOptions(filepath.Join(dir, "big"), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bigDb.Close()
+
+	for i := 0; i < 10; i++ {
+		for _, db := range []*Db{smallDb, bigDb} {
+			if err := db.Put("key"+strconv.Itoa(i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	smallFiles, err := filepath.Glob(filepath.Join(dir, "small", "small-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(smallFiles) < 3 {
+		t.Errorf("ERROR! Expected several small segments, got %v", smallFiles)
+	}
+	bigFiles, err := filepath.Glob(filepath.Join(dir, "big", "segment-data-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bigFiles) != 1 {
+		t.Errorf("ERROR! Expected a single segment, got %v", bigFiles)
+	}
+
+	t.Run("reopen with the same prefix", func(t *testing.T) {
+		smallDb.Close()
+		smallDb, err = NewDbWithOptions(filepath.Join(dir, "small"), small)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := smallDb.Get("key0"); err != nil || value != "value" {
+			t.Errorf("ERROR!\nExpected: value;\nGot: %s (%v)", value, err)
+		}
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		invalid := []func(*Options){
+			func(o *Options) { o.SegmentSize = 0 },
+			func(o *Options) { o.SegmentPrefix = "" },
+			func(o *Options) { o.SegmentPrefix = "../segment-" },
+			func(o *Options) { o.Compaction = CompactionTrigger{SizeRatio: -1} },
+			func(o *Options) { o.Compaction = SizeTiered{MinSegments: 1} },
+			func(o *Options) { o.Compaction = GarbageRatio{Ratio: 2} },
+		}
+		for i, modify := range invalid {
+			opts := DefaultOptions()
+			modify(&opts)
+			if _, err := NewDbWithOptions(filepath.Join(dir, "invalid"), opts); err == nil {
+				t.Errorf("ERROR! Expected error for invalid options %d: %+v", i, opts)
+			}
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDb_ReadOnly(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 100
+	opts.Compaction = ManualCompaction{}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(key, strings.Repeat(key, 30)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	teams, err := db.CreateBucket("teams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := teams.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn record and a leftover of a merge must stay in place.
+	last := filepath.Join(dir, opts.SegmentPrefix+"3")
+	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.WriteFile(filepath.Join(dir, opts.SegmentPrefix+"0"+tempSuffix), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	listing := func(t *testing.T) map[string]int64 {
+		t.Helper()
+		res := make(map[string]int64)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil {
+				res[path] = info.Size()
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	before := listing(t)
+
+	db, err = OpenReadOnlyWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("reads", func(t *testing.T) {
+		if len(db.blocks) != 3 {
+			t.Errorf("ERROR!\nExpected: 3;\nGot: %d", len(db.blocks))
+		}
+		if value, err := db.Get("d"); err != nil || value != strings.Repeat("d", 30) {
+			t.Errorf("ERROR!\nExpected: %s;\nGot: %s (%v)", strings.Repeat("d", 30), value, err)
+		}
+		if _, err := db.Get("c"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		var keys []string
+		it := db.Scan("", "")
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, []string{"a", "b", "d"}) {
+			t.Errorf("ERROR!\nExpected: [a b d];\nGot: %v (%v)", keys, it.Err())
+		}
+	})
+
+	t.Run("writes", func(t *testing.T) {
+		if err := db.Put("e", "value"); err != ErrReadOnly {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrReadOnly, err)
+		}
+		if err := db.Delete("a"); err != ErrReadOnly {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrReadOnly, err)
+		}
+		if err := db.PutReader("e", strings.NewReader("value"), -1); err != ErrReadOnly {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrReadOnly, err)
+		}
+		if err := db.Compact(); err != ErrReadOnly {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrReadOnly, err)
+		}
+	})
+
+	t.Run("buckets", func(t *testing.T) {
+		teams, err := db.Bucket("teams")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := teams.Get("key"); err != nil || value != "value" {
+			t.Errorf("ERROR!\nExpected: value;\nGot: %s (%v)", value, err)
+		}
+		if err := teams.Put("key", "new"); err != ErrReadOnly {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrReadOnly, err)
+		}
+		if _, err := db.Bucket("missing"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		if _, err := db.CreateBucket("missing"); err != ErrReadOnly {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrReadOnly, err)
+		}
+	})
+
+	t.Run("directory unchanged", func(t *testing.T) {
+		if after := listing(t); !reflect.DeepEqual(after, before) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", before, after)
+		}
+	})
+
+	t.Run("missing directory", func(t *testing.T) {
+		missing := filepath.Join(dir, "missing")
+		if _, err := OpenReadOnly(missing); err == nil {
+			t.Error("ERROR! Expected error for a missing directory")
+		}
+		if _, err := os.Stat(missing); !os.IsNotExist(err) {
+			t.Errorf("ERROR! The directory is created: %v", err)
+		}
+	})
+}
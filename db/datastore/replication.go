@@ -0,0 +1,361 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Cursor is the replication position of a follower. Segment, Generation and
+// Offset point to the next record to send, Version is the highest version of
+// the records already replicated from the segments before it.
+//
+// Versions grow in the write order, except inside a merged segment, so the
+// cursor is still valid when a merge replaces the segment it points to: a
+// merged segment never takes the name of a previous one, and the segments are
+// read again from the beginning skipping the replicated records.
+type Cursor struct {
+	Segment    int
+	Generation int
+	Offset     int64
+	Version    uint64
+}
+
+// Changes is a stream of the encoded records written after a cursor. The
+// records are read from the segments as the stream is consumed, it has its
+// own files, which stay readable after a merge removes the segments. The
+// stream must be closed.
+type Changes struct {
+	// Next is the cursor to continue from.
+	Next Cursor
+	// Size is the number of bytes in the stream.
+	Size int64
+
+	r     io.Reader
+	files []*os.File
+}
+
+func (c *Changes) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *Changes) Close() error {
+	var res error
+	for _, f := range c.files {
+		if err := f.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// ReadChanges returns the encoded records written after the cursor, up to
+// limit bytes, and the cursor to continue from. The records are applied to a
+// follower with ApplyChanges. Changes streams them instead of holding them
+// in memory.
+func (db *Db) ReadChanges(from Cursor, limit int) ([]byte, Cursor, error) {
+	changes, err := db.Changes(from, limit)
+	if err != nil {
+		return nil, from, err
+	}
+	defer changes.Close()
+	data, err := io.ReadAll(changes)
+	if err != nil {
+		return nil, from, err
+	}
+	return data, changes.Next, nil
+}
+
+// Changes returns a stream of the records written after the cursor, which
+// ends after the first record reaching limit bytes.
+//
+// A merge drops overwritten records, but once the db is replicated it keeps
+// the deleted and expired ones, so a follower lagging behind the merge still
+// sees them.
+func (db *Db) Changes(from Cursor, limit int) (*Changes, error) {
+	db.keepTombstones.Store(true)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for i, b := range db.blocks {
+		if db.segmentIDOf(b) != (segmentID{from.Segment, from.Generation}) {
+			continue
+		}
+		if end, _ := b.lastWritten(); from.Offset <= end {
+			changes, err := db.changes(i, from, limit)
+			if err != errCorrupted {
+				return changes, err
+			}
+		}
+		break
+	}
+	// The segment was merged or the offset does not point to a record.
+	return db.changes(0, Cursor{Version: from.Version}, limit)
+}
+
+// changes checks the records to send and collects their byte ranges, the
+// records are copied as is when the stream is read.
+func (db *Db) changes(start int, from Cursor, limit int) (*Changes, error) {
+	c := &Changes{Next: from}
+	var ranges []io.Reader
+	offset := from.Offset
+	for i := start; i < len(db.blocks); i++ {
+		b := db.blocks[i]
+		if i > start {
+			offset = 0
+		}
+		end, maxVersion := b.lastWritten()
+		id := db.segmentIDOf(b)
+		c.Next.Segment, c.Next.Generation = id.number, id.generation
+
+		if !replicated(maxVersion, from.Version) {
+			file, err := os.Open(b.outPath)
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+			c.files = append(c.files, file)
+
+			// The range of the records to send, which are not separated by
+			// the replicated ones.
+			rangeStart := int64(-1)
+			endRange := func() {
+				if rangeStart >= 0 {
+					ranges = append(ranges, io.NewSectionReader(file, rangeStart, offset-rangeStart))
+					rangeStart = -1
+				}
+			}
+			for offset < end && c.Size < int64(limit) {
+				size, version, err := checkRecord(file, offset, end)
+				if err != nil {
+					c.Close()
+					return nil, err
+				}
+				if replicated(version, from.Version) {
+					endRange()
+				} else {
+					if rangeStart < 0 {
+						rangeStart = offset
+					}
+					c.Size += size
+				}
+				offset += size
+			}
+			endRange()
+			if offset < end {
+				c.Next.Offset = offset
+				c.r = io.MultiReader(ranges...)
+				return c, nil
+			}
+		}
+
+		c.Next.Offset = end
+		if maxVersion > c.Next.Version {
+			c.Next.Version = maxVersion
+		}
+	}
+	c.r = io.MultiReader(ranges...)
+	return c, nil
+}
+
+// checkRecord checks the record at the offset before the end of the segment
+// without holding its value and returns its size and version.
+func checkRecord(file *os.File, offset, end int64) (int64, uint64, error) {
+	header := make([]byte, 4)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = errCorrupted
+		}
+		return 0, 0, err
+	}
+	size, ok := recordSize(header)
+	if !ok || size > end-offset {
+		return 0, 0, errCorrupted
+	}
+
+	var e Entry
+	var err error
+	if legacyRecord(header) {
+		e, err = readEntry(file, offset)
+		if err == nil && !e.valid() {
+			err = errCorrupted
+		}
+	} else {
+		e, err = skimRecord(io.NewSectionReader(file, offset, size))
+		if err == nil && e.badCRC {
+			err = errCorrupted
+		}
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = errCorrupted
+	}
+	return size, e.version, err
+}
+
+// replicated reports whether a record with the version is already sent to a
+// follower with the cursor version. A new follower also needs the records
+// written before versions.
+func replicated(version, cursorVersion uint64) bool {
+	return cursorVersion != 0 && version <= cursorVersion
+}
+
+// ApplyChanges writes the records read from r, as streamed by Changes of
+// another database, keeping their versions. Records larger than bufSize are
+// spooled to a temporary file and copied to the segment as is, so a large value
+// is never held in memory. The records are synced to the disk whatever the
+// durability mode is, so a cursor saved after it is never ahead of the data.
+func (db *Db) ApplyChanges(r io.Reader) error {
+	header := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			return errCorrupted
+		}
+		if err != nil {
+			return err
+		}
+		size, ok := recordSize(header)
+		if !ok {
+			return errCorrupted
+		}
+
+		if size <= bufSize || legacyRecord(header) {
+			err = db.applyRecord(header, r, size)
+		} else {
+			err = db.applySpooled(header, r, size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return db.sync()
+}
+
+// applyRecord decodes the record of the size starting with the header in
+// memory and writes it.
+func (db *Db) applyRecord(header []byte, r io.Reader, size int64) error {
+	data := make([]byte, size)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[len(header):]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errCorrupted
+		}
+		return err
+	}
+	var e Entry
+	if err := e.Decode(data); err != nil {
+		return err
+	}
+	if !e.valid() {
+		return errCorrupted
+	}
+	return db.write(writeArgument{entry: &e, replicated: true}, nil)
+}
+
+// applySpooled spools the CRC format record of the size starting with the
+// header and copies it to the segment after checking it.
+func (db *Db) applySpooled(header []byte, r io.Reader, size int64) error {
+	body, err := db.spool(io.MultiReader(bytes.NewReader(header), r), size)
+	if err == io.ErrUnexpectedEOF {
+		return errCorrupted
+	}
+	if err != nil {
+		return err
+	}
+	defer body.remove()
+
+	record := io.NewSectionReader(body.file, 0, size)
+	e, err := skimRecord(record)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errCorrupted
+	}
+	if err != nil {
+		return err
+	}
+	if read, _ := record.Seek(0, io.SeekCurrent); read != size || !e.valid() {
+		return errCorrupted
+	}
+	if e.isBatch() {
+		// The index is built from the entries of a batch, so it is decoded.
+		data := make([]byte, size)
+		if _, err := body.file.ReadAt(data, 0); err != nil {
+			return err
+		}
+		return db.applyRecord(data[:4], bytes.NewReader(data[4:]), size)
+	}
+	record.Seek(0, io.SeekStart)
+	return db.write(writeArgument{entry: &e, record: record, replicated: true}, nil)
+}
+
+// sync flushes the segments written without an fsync, so the applied records
+// are on the disk before the follower saves its cursor.
+func (db *Db) sync() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, b := range db.blocks {
+		if err := b.sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Version returns the highest version assigned to a record.
+func (db *Db) Version() uint64 {
+	return db.versions.Load()
+}
+
+// cursorName is the file of the data directory keeping the replication cursor
+// of a follower.
+const cursorName = "CURSOR"
+
+// ReplicationCursor returns the cursor saved by SaveReplicationCursor, or the
+// zero cursor, which starts the replication from the beginning, if there is
+// none.
+func (db *Db) ReplicationCursor() (Cursor, error) {
+	var c Cursor
+	data, err := os.ReadFile(filepath.Join(db.dir, cursorName))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if _, err := fmt.Sscan(string(data), &c.Segment, &c.Generation, &c.Offset, &c.Version); err != nil {
+		return c, fmt.Errorf("bad replication cursor: %w", err)
+	}
+	return c, nil
+}
+
+// SaveReplicationCursor keeps the cursor in the data directory, so a follower
+// continues where it stopped after a restart. It is saved after the changes
+// are applied: the changes applied again after a crash in between keep their
+// versions and leave the same records.
+func (db *Db) SaveReplicationCursor(c Cursor) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	path := filepath.Join(db.dir, cursorName)
+	f, err := os.Create(path + tempSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d %d %d\n", c.Segment, c.Generation, c.Offset, c.Version)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
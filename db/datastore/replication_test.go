@@ -0,0 +1,210 @@
+package datastore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Replication(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 300
+	// Merge only when the test asks for it.
+	opts.Compaction = CompactionTrigger{MaxSegments: 100}
+	primary, err := NewDbWithOptions(filepath.Join(dir, "primary"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	follower, err := NewDbWithOptions(filepath.Join(dir, "follower"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { follower.Close() }()
+
+	var cursor Cursor
+	replicate := func(t *testing.T) {
+		t.Helper()
+		for {
+			data, next, err := primary.ReadChanges(cursor, 200)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := follower.ApplyChanges(bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			// The cursor must not get ahead of the records on the disk.
+			for _, b := range follower.blocks {
+				if b.unsynced.Load() {
+					t.Fatalf("ERROR! Segment %s is not synced before the cursor is saved", b.outPath)
+				}
+			}
+			if err := follower.SaveReplicationCursor(next); err != nil {
+				t.Fatal(err)
+			}
+			cursor = next
+			if len(data) == 0 {
+				return
+			}
+		}
+	}
+	check := func(t *testing.T, keys ...string) {
+		t.Helper()
+		if primary.Version() != follower.Version() {
+			t.Errorf("ERROR! Primary version %d, follower version %d", primary.Version(), follower.Version())
+		}
+		for _, key := range keys {
+			want, wantVersion, wantErr := primary.GetWithVersion(key)
+			got, gotVersion, gotErr := follower.GetWithVersion(key)
+			if gotErr != wantErr || gotVersion != wantVersion || (wantErr == nil && got.(string) != want.(string)) {
+				t.Errorf("ERROR! %s\nExpected: %v (%d, %v);\nGot: %v (%d, %v)", key, want, wantVersion, wantErr, got, gotVersion, gotErr)
+			}
+		}
+	}
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, "key"+strconv.Itoa(i))
+		if err := primary.Put(keys[i], "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("initial sync", func(t *testing.T) {
+		if err := primary.Delete("key1"); err != nil {
+			t.Fatal(err)
+		}
+		wb := new(WriteBatch)
+		wb.Put("key2", "batch")
+		wb.Put("key3", "batch")
+		if err := primary.Batch(wb); err != nil {
+			t.Fatal(err)
+		}
+		replicate(t)
+		check(t, keys...)
+	})
+
+	t.Run("tail after merge", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			if err := primary.Put(keys[i], "updated"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		primary.SetCompactionPolicy(CompactionTrigger{MaxSegments: 1})
+		if err := primary.compact(); err != nil {
+			t.Fatal(err)
+		}
+		if err := primary.Put("key19", "after merge"); err != nil {
+			t.Fatal(err)
+		}
+		replicate(t)
+		check(t, keys...)
+	})
+
+	t.Run("bad offset", func(t *testing.T) {
+		if err := primary.Put("key5", "again"); err != nil {
+			t.Fatal(err)
+		}
+		cursor.Offset++
+		replicate(t)
+		check(t, keys...)
+	})
+
+	t.Run("follower restart", func(t *testing.T) {
+		follower.Close()
+		follower, err = NewDbWithOptions(filepath.Join(dir, "follower"), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := primary.Put("key6", "again"); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := follower.ReplicationCursor()
+		if err != nil || saved != cursor {
+			t.Errorf("ERROR!\nExpected: %+v;\nGot: %+v (%v)", cursor, saved, err)
+		}
+		cursor = saved
+		replicate(t)
+		check(t, keys...)
+	})
+
+	// Records of the same size, so a stale offset lands on a record of a
+	// rewritten segment.
+	putAll := func(t *testing.T, value string) {
+		t.Helper()
+		for _, key := range keys {
+			if err := primary.Put(key, value+strings.Repeat("-", 8-len(key))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("merge under the cursor", func(t *testing.T) {
+		primary.SetCompactionPolicy(ManualCompaction{})
+		putAll(t, "old")
+		if err := primary.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		// Pull a part of the merged segment.
+		data, next, err := primary.ReadChanges(Cursor{}, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := follower.ApplyChanges(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		cursor = next
+		if merged := primary.segmentIDOf(primary.blocks[0]); cursor.Segment != merged.number || cursor.Generation != merged.generation || cursor.Offset == 0 {
+			t.Fatalf("ERROR! The cursor %+v is not inside the merged segment %+v", cursor, merged)
+		}
+
+		putAll(t, "new")
+		if err := primary.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		replicate(t)
+		check(t, keys...)
+	})
+
+	t.Run("tombstones under a merge", func(t *testing.T) {
+		// The follower has the values, a merge of all the segments must not
+		// drop the records hiding them before it catches up.
+		if err := primary.Delete("key4"); err != nil {
+			t.Fatal(err)
+		}
+		if err := primary.PutWithTTL("key5", "expired", time.Nanosecond); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+		if err := primary.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		replicate(t)
+		check(t, keys...)
+	})
+
+	t.Run("unversioned records", func(t *testing.T) {
+		version := follower.Version()
+		old := Entry{key: "old", value: "value", valueType: typeString}
+		if err := follower.ApplyChanges(bytes.NewReader(old.Encode())); err != nil {
+			t.Fatal(err)
+		}
+		if follower.Version() != version {
+			t.Errorf("ERROR!\nExpected: version %d;\nGot: %d", version, follower.Version())
+		}
+		value, gotVersion, err := follower.GetWithVersion("old")
+		if err != nil || value != "value" || gotVersion != 0 {
+			t.Errorf("ERROR!\nExpected: value (0);\nGot: %v (%d, %v)", value, gotVersion, err)
+		}
+	})
+}
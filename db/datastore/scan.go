@@ -0,0 +1,100 @@
+package datastore
+
+// Iterator walks over the live keys of a Scan in ascending order and returns
+// their newest values. It does not hold any locks, so it sees the writes made
+// after the scan started if they are ahead of its position.
+//
+//	it := db.ScanPrefix("team-")
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil { ... }
+type Iterator struct {
+	db       *Db
+	position string
+	end      string
+	entry    Entry
+	err      error
+	done     bool
+}
+
+// Scan returns an iterator over the keys in [start, end). An empty end means
+// there is no upper bound.
+func (db *Db) Scan(start, end string) *Iterator {
+	return &Iterator{db: db, position: start, end: end}
+}
+
+// ScanPrefix returns an iterator over the keys starting with the prefix.
+func (db *Db) ScanPrefix(prefix string) *Iterator {
+	return db.Scan(prefix, prefixEnd(prefix))
+}
+
+// prefixEnd returns the smallest key that is greater than all the keys with
+// the prefix, or an empty string if there is no such key.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Next advances the iterator to the next live key. It returns false when the
+// scan is over or an error happened.
+func (it *Iterator) Next() bool {
+	for !it.done {
+		key, ok := it.db.keys().ceiling(it.position)
+		if !ok || (it.end != "" && key >= it.end) {
+			it.done = true
+			break
+		}
+		// The smallest key after the current one.
+		it.position = key + "\x00"
+
+		e, err := it.db.get(key)
+		if err == ErrNotFound {
+			// Deleted keys stay in the ordered index until the next compaction.
+			continue
+		}
+		if err != nil {
+			it.err = err
+			it.done = true
+			break
+		}
+		it.entry = e
+		return true
+	}
+	it.entry = Entry{}
+	return false
+}
+
+// Seek moves the iterator, so the following Next returns the first key that
+// is greater than or equal to the given one.
+func (it *Iterator) Seek(key string) {
+	if key > it.position {
+		it.position = key
+	}
+}
+
+func (it *Iterator) Key() string {
+	return it.entry.key
+}
+
+// Value returns the current value as a string, like Db.Get.
+func (it *Iterator) Value() string {
+	value, _ := it.entry.stringValue()
+	return value
+}
+
+// TypedValue returns the current value with its stored type, like Db.GetValue.
+func (it *Iterator) TypedValue() interface{} {
+	value, _ := it.entry.typedValue()
+	return value
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
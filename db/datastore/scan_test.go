@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func collect(t *testing.T, it *Iterator) []string {
+	var res []string
+	for it.Next() {
+		res = append(res, it.Key()+"="+it.Value())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 200
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"team-b", "other", "team-a", "team-c", "teams"} {
+		if err := db.Put(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutInt64("team-d", 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("team-a", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("team-c"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"team-a=new", "team-b=team-b", "team-d=4"}
+	check := func(t *testing.T, db *Db) {
+		if res := collect(t, db.ScanPrefix("team-")); !reflect.DeepEqual(res, expected) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", expected, res)
+		}
+		if res := collect(t, db.Scan("team-b", "teams")); !reflect.DeepEqual(res, expected[1:]) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", expected[1:], res)
+		}
+		if res := collect(t, db.Scan("", "")); len(res) != 5 {
+			t.Errorf("ERROR! Expected 5 keys, got %v", res)
+		}
+	}
+
+	t.Run("same process", func(t *testing.T) {
+		check(t, db)
+	})
+
+	t.Run("after compaction", func(t *testing.T) {
+		db.SetCompactionPolicy(CompactionTrigger{MaxSegments: 1})
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+	})
+
+	t.Run("new DB process", func(t *testing.T) {
+		db.Close()
+		db, err = NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		check(t, db)
+	})
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"team-": "team.",
+		"a\xff": "b",
+		"\xff":  "",
+		"":      "",
+	}
+	for prefix, expected := range cases {
+		if end := prefixEnd(prefix); end != expected {
+			t.Errorf("Got bad end %q for %q, expected %q", end, prefix, expected)
+		}
+	}
+}
+
+func TestSkipList(t *testing.T) {
+	l := newSkipList()
+	var keys []string
+	for _, i := range rand.Perm(1000) {
+		key := strconv.Itoa(i)
+		keys = append(keys, key)
+		l.insert(key)
+		l.insert(key)
+	}
+	sort.Strings(keys)
+
+	if l.len() != len(keys) {
+		t.Errorf("Got bad length %d", l.len())
+	}
+	position := ""
+	for _, expected := range keys {
+		key, ok := l.ceiling(position)
+		if !ok || key != expected {
+			t.Fatalf("Got %q, expected %q", key, expected)
+		}
+		position = key + "\x00"
+	}
+	if _, ok := l.ceiling(position); ok {
+		t.Error("Expected no keys after the last one")
+	}
+}
+
+func TestIterator_Seek(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a1", "a2", "a3", "b1"} {
+		if err := db.Put(key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := db.ScanPrefix("a")
+	it.Seek("a1\x00")
+	if res := collect(t, it); !reflect.DeepEqual(res, []string{"a2=v", "a3=v"}) {
+		t.Errorf("ERROR! Got %v", res)
+	}
+
+	// Seeking before the scan start does not widen the range.
+	it = db.ScanPrefix("b")
+	it.Seek("a")
+	if res := collect(t, it); !reflect.DeepEqual(res, []string{"b1=v"}) {
+		t.Errorf("ERROR! Got %v", res)
+	}
+}
@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const skipListMaxLevel = 24
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+// skipList is an ordered set of keys safe for concurrent use.
+type skipList struct {
+	mu    sync.RWMutex
+	head  skipNode
+	level int
+	size  int
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// insert adds the key, it does nothing if the key is already present.
+func (l *skipList) insert(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var update [skipListMaxLevel]*skipNode
+	node := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	if next := node.next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := randomLevel()
+	for i := l.level; i < level; i++ {
+		update[i] = &l.head
+	}
+	if level > l.level {
+		l.level = level
+	}
+
+	inserted := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		inserted.next[i] = update[i].next[i]
+		update[i].next[i] = inserted
+	}
+	l.size++
+}
+
+// ceiling returns the smallest key that is greater than or equal to the given one.
+func (l *skipList) ceiling(key string) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	node := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+	}
+	if next := node.next[0]; next != nil {
+		return next.key, true
+	}
+	return "", false
+}
+
+func (l *skipList) len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.size
+}
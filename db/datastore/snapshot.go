@@ -0,0 +1,150 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Snapshot saves a consistent copy of the database to dir, which must be
+// empty or missing. Sealed segments and their hints never change, so they
+// are hard-linked when dir is on the same file system; the active segment is
+// copied up to its last acknowledged record. The snapshot is opened with
+// NewDb like any other data directory or put in place by Restore. The
+// buckets are saved one after another after the default keyspace.
+func (db *Db) Snapshot(dir string) error {
+	if err := emptyDir(dir); err != nil {
+		return err
+	}
+
+	// Merges and segment rolls wait for the snapshot, writes to the active
+	// segment go on.
+	db.mu.RLock()
+	err := db.snapshot(dir)
+	db.mu.RUnlock()
+	if err == nil {
+		err = db.snapshotBuckets(dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+func (db *Db) snapshot(dir string) error {
+	last := len(db.blocks) - 1
+	for _, b := range db.blocks[:last] {
+		target := filepath.Join(dir, filepath.Base(b.outPath))
+		if err := linkOrCopy(b.outPath, target); err != nil {
+			return err
+		}
+		err := linkOrCopy(hintPath(b.outPath), hintPath(target))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	active := db.blocks[last]
+	return copyFile(active.outPath, filepath.Join(dir, filepath.Base(active.outPath)), active.written())
+}
+
+// Restore copies a snapshot made by Db.Snapshot to the data directory dir,
+// which must be empty or missing. The database must not be open in dir.
+func Restore(snapshotDir, dir string) error {
+	entries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		return err
+	}
+	if err := emptyDir(dir); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		src, dst := filepath.Join(snapshotDir, entry.Name()), filepath.Join(dir, entry.Name())
+		var err error
+		if entry.IsDir() && entry.Name() == bucketsDir {
+			err = restoreBuckets(src, dst)
+		} else if entry.Type().IsRegular() {
+			err = copyFile(src, dst, -1)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreBuckets(snapshotDir, dir string) error {
+	entries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		err := Restore(filepath.Join(snapshotDir, entry.Name()), filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emptyDir creates the directory if needed and fails if it has any files.
+func emptyDir(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("directory %s is not empty", dir)
+	}
+	return nil
+}
+
+// linkOrCopy hard-links the file or copies it if the link can't be made.
+func linkOrCopy(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil || os.IsNotExist(err) {
+		return err
+	}
+	return copyFile(src, dst, -1)
+}
+
+// copyFile copies the first n bytes of the file, the whole file if n is negative.
+func copyFile(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		_, err = io.Copy(out, in)
+	} else {
+		_, err = io.CopyN(out, in, n)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
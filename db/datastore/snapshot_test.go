@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDb_Snapshot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 300
+	db, err := NewDbWithOptions(filepath.Join(dir, "db"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshotDir := filepath.Join(dir, "snapshot")
+	t.Run("concurrent writes", func(t *testing.T) {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := db.Put("concurrent"+strconv.Itoa(i), "value"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		if err := db.Snapshot(snapshotDir); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+	})
+
+	// Changes made after the snapshot must not leak into it.
+	if err := db.Put("key0", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("late", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("restore", func(t *testing.T) {
+		restoredDir := filepath.Join(dir, "restored")
+		if err := Restore(snapshotDir, restoredDir); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := NewDbWithOptions(restoredDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+
+		for i := 0; i < 20; i++ {
+			value, err := restored.Get("key" + strconv.Itoa(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != "value"+strconv.Itoa(i) {
+				t.Errorf("ERROR!\nExpected: value%d;\nGot: %s", i, value)
+			}
+		}
+		if _, err := restored.Get("late"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	})
+
+	t.Run("not empty directory", func(t *testing.T) {
+		if err := db.Snapshot(snapshotDir); err == nil {
+			t.Error("ERROR! Expected an error for a snapshot to a non-empty directory")
+		}
+		if err := Restore(snapshotDir, filepath.Join(dir, "db")); err == nil {
+			t.Error("ERROR! Expected an error for a restore to a non-empty directory")
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import "path/filepath"
+
+// Stats describes the state of the database.
+type Stats struct {
+	Segments []SegmentStats `json:"segments"`
+	Keys     int            `json:"keys"`
+	// Bytes is the size of all the segments. LiveBytes are taken by the
+	// records holding the current values, the dead ones are reclaimed by
+	// merges. Expired records are counted as live until they are merged.
+	Bytes     int64      `json:"bytes"`
+	LiveBytes int64      `json:"liveBytes"`
+	DeadBytes int64      `json:"deadBytes"`
+	Merges    MergeStats `json:"merges"`
+	// GetLatency covers all the record lookups, including the ones of scans
+	// and deletes. PutLatency covers all the writes.
+	GetLatency  Histogram        `json:"getLatency"`
+	PutLatency  Histogram        `json:"putLatency"`
+	Compression CompressionStats `json:"compression"`
+	Cache       CacheStats       `json:"cache"`
+}
+
+// SegmentStats describes a segment, Keys counts the keys whose current value
+// is in it. DeadBytes are taken by the records overwritten or deleted later.
+type SegmentStats struct {
+	Name      string `json:"name"`
+	Keys      int    `json:"keys"`
+	Bytes     int64  `json:"bytes"`
+	LiveBytes int64  `json:"liveBytes"`
+	DeadBytes int64  `json:"deadBytes"`
+}
+
+func (db *Db) Stats() Stats {
+	stats := Stats{
+		Merges:      db.merges.snapshot(),
+		GetLatency:  db.getLatency.snapshot(),
+		PutLatency:  db.putLatency.snapshot(),
+		Compression: db.CompressionStats(),
+		Cache:       db.CacheStats(),
+	}
+	db.mu.RLock()
+	stats.Segments = segmentStats(db.blocks)
+	db.mu.RUnlock()
+
+	for _, s := range stats.Segments {
+		stats.Keys += s.Keys
+		stats.Bytes += s.Bytes
+		stats.LiveBytes += s.LiveBytes
+	}
+	stats.DeadBytes = stats.Bytes - stats.LiveBytes
+	return stats
+}
+
+// segmentStats finds the live records of the blocks, which hold the newest
+// values of the keys. It must be called with db.mu held.
+func segmentStats(blocks []*block) []SegmentStats {
+	res := make([]SegmentStats, len(blocks))
+	seen := make(map[string]struct{})
+	for j := len(blocks) - 1; j >= 0; j-- {
+		b := blocks[j]
+		s := SegmentStats{Name: filepath.Base(b.outPath)}
+		b.rwmu.RLock()
+		s.Bytes = b.outOffset
+		for key, loc := range b.index {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			if _, deleted := b.deleted[key]; !deleted {
+				s.Keys++
+				s.LiveBytes += loc.size
+			}
+		}
+		b.rwmu.RUnlock()
+		s.DeadBytes = s.Bytes - s.LiveBytes
+		res[j] = s
+	}
+	return res
+}
@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Stats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Compaction = CompactionTrigger{MaxSegments: 100}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	entries := []Entry{
+		newValueEntry("key1", "old", typeString),
+		newValueEntry("key1", "new", typeString),
+		newValueEntry("key2", "value2", typeString),
+		newTombstone("key2"),
+		newValueEntry("key3", "value3", typeString),
+	}
+	var written int64
+	for _, e := range entries {
+		if err := db.append(e); err != nil {
+			t.Fatal(err)
+		}
+		written += int64(len(e.Encode()))
+	}
+	live := int64(len(entries[1].Encode()) + len(entries[4].Encode()))
+	for _, key := range []string{"key1", "key2", "key3"} {
+		db.Get(key)
+	}
+
+	t.Run("live and dead bytes", func(t *testing.T) {
+		stats := db.Stats()
+		if stats.Keys != 2 || stats.Bytes != written || stats.LiveBytes != live || stats.DeadBytes != written-live {
+			t.Errorf("ERROR! Unexpected stats %+v", stats)
+		}
+		want := []SegmentStats{{Name: opts.SegmentPrefix + "1", Keys: 2, Bytes: written, LiveBytes: live, DeadBytes: written - live}}
+		if !reflect.DeepEqual(stats.Segments, want) {
+			t.Errorf("ERROR!\nExpected: %+v;\nGot: %+v", want, stats.Segments)
+		}
+	})
+
+	t.Run("latencies", func(t *testing.T) {
+		stats := db.Stats()
+		if stats.GetLatency.Count != 3 || stats.PutLatency.Count != 5 {
+			t.Errorf("ERROR! Unexpected counts %d and %d", stats.GetLatency.Count, stats.PutLatency.Count)
+		}
+		buckets := stats.GetLatency.Buckets
+		if len(buckets) != len(latencyBuckets) || buckets[len(buckets)-1].Count > stats.GetLatency.Count || stats.GetLatency.Sum <= 0 {
+			t.Errorf("ERROR! Unexpected histogram %+v", stats.GetLatency)
+		}
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i].Count < buckets[i-1].Count {
+				t.Errorf("ERROR! Buckets are not cumulative %+v", buckets)
+			}
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		db.SetCompactionPolicy(CompactionTrigger{MaxSegments: 1})
+		db.mu.Lock()
+		if err := db.addNewBlockToDB(); err != nil {
+			t.Fatal(err)
+		}
+		db.mu.Unlock()
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		stats := db.Stats()
+		if stats.Merges.Count == 0 || stats.Merges.Failed != 0 || stats.Merges.LastSeconds <= 0 {
+			t.Errorf("ERROR! Unexpected merge stats %+v", stats.Merges)
+		}
+		if stats.Keys != 2 || stats.Bytes != live || stats.DeadBytes != 0 || len(stats.Segments) != 2 {
+			t.Errorf("ERROR! Unexpected stats %+v", stats)
+		}
+
+		// The sizes of the records are kept in the hint.
+		db.Close()
+		db, err = NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !db.blocks[0].hinted {
+			t.Fatal("ERROR! The merged segment is recovered without the hint")
+		}
+		if reopened := db.Stats(); !reflect.DeepEqual(reopened.Segments, stats.Segments) {
+			t.Errorf("ERROR!\nExpected: %+v;\nGot: %+v", stats.Segments, reopened.Segments)
+		}
+	})
+}
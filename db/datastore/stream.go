@@ -0,0 +1,304 @@
+package datastore
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// valueBody is the value of an entry written by PutReader. It is spooled to a
+// file first, so a slow reader does not hold up the other writes.
+type valueBody struct {
+	file *os.File
+	size int64
+}
+
+// PutReader stores the bytes read from r as a bytes value without holding them
+// in memory. The size is the number of bytes to read, or -1 to read r to the
+// end. Streamed values are not compressed.
+func (db *Db) PutReader(key string, r io.Reader, size int64) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	body, err := db.spool(r, size)
+	if err != nil {
+		return err
+	}
+	defer body.remove()
+
+	// The record size has to fit in 31 bits.
+	if int64(len(key))+body.size+minRecordSize > int64(^formatCRC) {
+		return fmt.Errorf("value of %d bytes is too large", body.size)
+	}
+	return db.append(Entry{key: key, valueType: typeBytes, body: body})
+}
+
+// spool copies the value to a temporary file in the database directory, which
+// is removed by recovery if the process crashes before the write.
+func (db *Db) spool(r io.Reader, size int64) (*valueBody, error) {
+	f, err := os.CreateTemp(db.dir, "value-*"+tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	body := &valueBody{file: f}
+	if size < 0 {
+		body.size, err = io.Copy(f, r)
+	} else {
+		body.size, err = io.CopyN(f, r, size)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		body.remove()
+		return nil, err
+	}
+	return body, nil
+}
+
+func (v *valueBody) remove() {
+	v.file.Close()
+	os.Remove(v.file.Name())
+}
+
+// writeTo writes the encoded entry, a streamed value is copied from its spool file.
+func (e *Entry) writeTo(w io.Writer) (int, error) {
+	if e.body == nil {
+		return w.Write(e.Encode())
+	}
+
+	kl := len(e.key)
+	size := int64(kl+minRecordSize) + e.body.size
+	head := make([]byte, kl+12)
+	binary.LittleEndian.PutUint32(head, uint32(size)|formatCRC)
+	binary.LittleEndian.PutUint32(head[4:], uint32(kl))
+	copy(head[8:], e.key)
+	binary.LittleEndian.PutUint32(head[kl+8:], uint32(e.body.size))
+	if _, err := e.body.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	crc := crc32.New(crcTable)
+	out := io.MultiWriter(w, crc)
+	n, err := out.Write(head)
+	if err != nil {
+		return n, err
+	}
+	copied, err := io.CopyN(out, e.body.file, e.body.size)
+	n += int(copied)
+	if err != nil {
+		return n, err
+	}
+	tail := make([]byte, crcTrailerSize)
+	e.encodeTrailer(tail)
+	crc.Write(tail[:crcTrailerSize-4])
+	binary.LittleEndian.PutUint32(tail[crcTrailerSize-4:], crc.Sum32())
+	m, err := w.Write(tail)
+	return n + m, err
+}
+
+// GetReader returns a reader of the string or bytes value, which reads it from
+// the segment as it is consumed. The checksum is checked at the end of the
+// value, so a damaged record makes Read fail instead of returning io.EOF. The
+// reader must be closed.
+func (db *Db) GetReader(key string) (io.ReadCloser, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for j := len(db.blocks) - 1; j >= 0; j-- {
+		position, err := db.blocks[j].locate(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err == errDeleted {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The reader has its own file, which stays readable after a merge
+		// removes the segment.
+		f, err := os.Open(db.blocks[j].outPath)
+		if err != nil {
+			return nil, err
+		}
+		r, err := db.valueReader(f, key, position)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &fileReader{r, f}, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (db *Db) valueReader(f *os.File, key string, position int64) (io.Reader, error) {
+	header := make([]byte, 4)
+	if _, err := f.ReadAt(header, position); err != nil {
+		return nil, err
+	}
+
+	var (
+		e     Entry
+		value io.Reader
+		err   error
+	)
+	if legacyRecord(header) {
+		// Legacy records are read as a whole, they are never large.
+		e, err = readEntry(f, position)
+		if err == nil && !e.valid() {
+			err = errCorrupted
+		}
+		value = strings.NewReader(e.value)
+	} else {
+		e, value, err = openRecord(f, position)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if e.key != key {
+		return nil, errCorrupted
+	}
+	if e.expired(db.now()) {
+		return nil, ErrNotFound
+	}
+	if e.valueType != typeString && e.valueType != typeBytes {
+		return nil, ErrWrongType
+	}
+	if e.flags&flagCompressed != 0 {
+		gz, err := gzip.NewReader(value)
+		if err != nil {
+			return nil, errCorrupted
+		}
+		value = gz
+	}
+	return value, nil
+}
+
+// openRecord reads the key and the trailer of the CRC format record at the
+// position and returns a reader of its stored value checking the CRC.
+func openRecord(f *os.File, position int64) (Entry, io.Reader, error) {
+	crc := crc32.New(crcTable)
+	key, vl, err := readHead(io.NewSectionReader(f, position, math.MaxInt64-position), crc)
+	if err != nil {
+		return Entry{}, nil, err
+	}
+	valueOffset := position + int64(len(key)) + 12
+
+	tail := make([]byte, crcTrailerSize)
+	if _, err := f.ReadAt(tail, valueOffset+vl); err != nil {
+		return Entry{}, nil, err
+	}
+	e := Entry{key: key}
+	e.decodeTrailer(tail)
+	return e, &checkedReader{r: io.NewSectionReader(f, valueOffset, vl), crc: crc, tail: tail}, nil
+}
+
+// skimRecord reads a CRC format record from r without holding its value, the
+// value is only passed through the CRC. The returned entry has no value.
+func skimRecord(r io.Reader) (Entry, error) {
+	crc := crc32.New(crcTable)
+	key, vl, err := readHead(r, crc)
+	if err != nil {
+		return Entry{}, err
+	}
+	if _, err := io.CopyN(crc, r, vl); err != nil {
+		return Entry{}, err
+	}
+	tail := make([]byte, crcTrailerSize)
+	if _, err := io.ReadFull(r, tail); err != nil {
+		return Entry{}, err
+	}
+
+	e := Entry{key: key}
+	e.decodeTrailer(tail)
+	crc.Write(tail[:crcTrailerSize-4])
+	e.badCRC = crc.Sum32() != binary.LittleEndian.Uint32(tail[crcTrailerSize-4:])
+	return e, nil
+}
+
+// copyRecord copies the CRC format record read by r checking its CRC. The
+// copy is not complete if the check fails.
+func copyRecord(w io.Writer, r *io.SectionReader) (int, error) {
+	crc := crc32.New(crcTable)
+	n, err := io.CopyN(io.MultiWriter(w, crc), r, r.Size()-4)
+	if err != nil {
+		return int(n), err
+	}
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return int(n), err
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(sum) {
+		return int(n), errCorrupted
+	}
+	m, err := w.Write(sum)
+	return int(n) + m, err
+}
+
+// readHead reads the lengths and the key of a CRC format record and passes
+// them to the crc. It returns the key and the value length.
+func readHead(r io.Reader, crc hash.Hash32) (string, int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, err
+	}
+	size, ok := recordSize(header)
+	kl := int64(binary.LittleEndian.Uint32(header[4:]))
+	if legacyRecord(header) || !ok || kl > size-minRecordSize {
+		return "", 0, errCorrupted
+	}
+
+	keyLength := make([]byte, kl+4)
+	if _, err := io.ReadFull(r, keyLength); err != nil {
+		return "", 0, err
+	}
+	vl := int64(binary.LittleEndian.Uint32(keyLength[kl:]))
+	if vl != size-minRecordSize-kl {
+		return "", 0, errCorrupted
+	}
+	crc.Write(header)
+	crc.Write(keyLength)
+	return string(keyLength[:kl]), vl, nil
+}
+
+// checkedReader passes the value through the CRC and checks it at the end.
+type checkedReader struct {
+	r    io.Reader
+	crc  hash.Hash32
+	tail []byte
+	err  error
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	if err == io.EOF {
+		c.crc.Write(c.tail[:crcTrailerSize-4])
+		if c.crc.Sum32() != binary.LittleEndian.Uint32(c.tail[crcTrailerSize-4:]) {
+			err = errCorrupted
+		}
+	}
+	c.err = err
+	return n, err
+}
+
+type fileReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *fileReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,257 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_Stream(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Compression = true
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	// Larger than the recovery buffer, so recovery skims the record.
+	large := bytes.Repeat([]byte("0123456789abcdef"), 4*bufSize)
+	if err := db.PutReader("large", bytes.NewReader(large), int64(len(large))); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutReader("unsized", strings.NewReader("streamed"), -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("compressed", strings.Repeat("value", 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(t *testing.T, key string) []byte {
+		t.Helper()
+		r, err := db.GetReader(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	check := func(t *testing.T) {
+		t.Helper()
+		if data := read(t, "large"); !bytes.Equal(data, large) {
+			t.Errorf("ERROR! Got %d bytes instead of %d", len(data), len(large))
+		}
+		if data := read(t, "unsized"); string(data) != "streamed" {
+			t.Errorf("ERROR!\nExpected: streamed;\nGot: %s", data)
+		}
+		if data := read(t, "compressed"); string(data) != strings.Repeat("value", 100) {
+			t.Errorf("ERROR! Got a bad decompressed value %q", data)
+		}
+	}
+
+	t.Run("read", func(t *testing.T) {
+		check(t)
+		if value, err := db.GetBytes("unsized"); err != nil || string(value) != "streamed" {
+			t.Errorf("ERROR!\nExpected: streamed;\nGot: %s (%v)", value, err)
+		}
+	})
+
+	t.Run("recover", func(t *testing.T) {
+		db.Close()
+		db, err = NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.blocks[0].dropped != 0 {
+			t.Errorf("ERROR! Recovery dropped %d bytes", db.blocks[0].dropped)
+		}
+		check(t)
+	})
+
+	t.Run("missing values", func(t *testing.T) {
+		if _, err := db.GetReader("missing"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		if err := db.Delete("unsized"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetReader("unsized"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		if err := db.PutInt64("number", 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetReader("number"); err != ErrWrongType {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrWrongType, err)
+		}
+	})
+
+	t.Run("short reader", func(t *testing.T) {
+		err := db.PutReader("short", strings.NewReader("abc"), 10)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", io.ErrUnexpectedEOF, err)
+		}
+		if _, err := db.Get("short"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), tempSuffix) {
+				t.Errorf("ERROR! Spool file %s is left", entry.Name())
+			}
+		}
+	})
+
+	t.Run("damaged value", func(t *testing.T) {
+		db.Close()
+		path := db.blocks[0].outPath
+		f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte("X"), 100); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		// Recovery refuses the damaged segment instead of dropping the
+		// records after the damaged one, a repair keeps them.
+		if _, err := NewDbWithOptions(dir, opts); !errors.Is(err, errCorrupted) {
+			t.Fatalf("ERROR!\nExpected: %v;\nGot: %v", errCorrupted, err)
+		}
+		if _, err := RepairSegment(path); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetReader("large"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		if data := read(t, "compressed"); string(data) != strings.Repeat("value", 100) {
+			t.Errorf("ERROR! Got a bad decompressed value %q", data)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		if err := db.PutReader("large", bytes.NewReader(large), int64(len(large))); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if data := read(t, "large"); !bytes.Equal(data, large) {
+			t.Errorf("ERROR! Got %d bytes instead of %d", len(data), len(large))
+		}
+		if data := read(t, "compressed"); string(data) != strings.Repeat("value", 100) {
+			t.Errorf("ERROR! Got a bad decompressed value %q", data)
+		}
+	})
+
+	t.Run("replicate", func(t *testing.T) {
+		followerDir, err := os.MkdirTemp("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(followerDir)
+		follower, err := NewDb(followerDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer follower.Close()
+
+		// A record per call, the large one goes over the limit and is
+		// streamed to the follower.
+		var cursor Cursor
+		for {
+			changes, err := db.Changes(cursor, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = follower.ApplyChanges(changes)
+			changes.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cursor = changes.Next
+			if changes.Size == 0 {
+				break
+			}
+		}
+		r, err := follower.GetReader("large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if data, err := io.ReadAll(r); err != nil || !bytes.Equal(data, large) {
+			t.Errorf("ERROR! Got %d bytes instead of %d (%v)", len(data), len(large), err)
+		}
+
+		e := Entry{key: "damaged", value: string(large), valueType: typeBytes, version: db.Version() + 1}
+		record := e.Encode()
+		damaged := append([]byte(nil), record...)
+		damaged[len(damaged)/2] ^= 1
+		for name, data := range map[string][]byte{"damaged": damaged, "truncated": record[:len(record)-10]} {
+			if err := follower.ApplyChanges(bytes.NewReader(data)); err != errCorrupted {
+				t.Errorf("ERROR! %s record\nExpected: %v;\nGot: %v", name, errCorrupted, err)
+			}
+		}
+		if _, err := follower.GetReader("damaged"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	})
+}
+
+func TestDb_StreamDamagedRead(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := strings.Repeat("v", 1000)
+	if err := db.PutReader("key", strings.NewReader(value), -1); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(db.blocks[0].outPath, os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("X"), 500); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	r, err := db.GetReader("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != errCorrupted || len(data) != len(value) {
+		t.Errorf("ERROR!\nExpected: %v;\nGot: %v after %d bytes", errCorrupted, err, len(data))
+	}
+}
@@ -0,0 +1,54 @@
+package datastore
+
+import "fmt"
+
+// ErrVersionMismatch is returned by conditional writes when the key has
+// another version than the expected one.
+var ErrVersionMismatch = fmt.Errorf("record version does not match")
+
+// GetWithVersion returns the value as GetValue does together with the version
+// of its record.
+func (db *Db) GetWithVersion(key string) (interface{}, uint64, error) {
+	e, err := db.get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	value, err := e.typedValue()
+	return value, e.version, err
+}
+
+// CompareAndSwap stores the value only if the current record of the key has
+// the expected version. Zero stands for a missing key as well as for records
+// written before versions. It returns the version of the new record.
+func (db *Db) CompareAndSwap(key string, version uint64, value string) (uint64, error) {
+	e := newValueEntry(key, value, typeString)
+	err := db.appendIf(&e, expectVersion(version))
+	if err != nil {
+		return 0, err
+	}
+	return e.version, nil
+}
+
+// CompareAndDelete deletes the key only if its current record has the expected version.
+func (db *Db) CompareAndDelete(key string, version uint64) error {
+	e := newTombstone(key)
+	check := expectVersion(version)
+	return db.appendIf(&e, func(e *Entry, current Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		return check(e, current, err)
+	})
+}
+
+func expectVersion(version uint64) condition {
+	return func(_ *Entry, current Entry, err error) error {
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if current.version != version {
+			return ErrVersionMismatch
+		}
+		return nil
+	}
+}
@@ -0,0 +1,189 @@
+package datastore
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDb_Versions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	version := func(key string) uint64 {
+		t.Helper()
+		_, v, err := db.GetWithVersion(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	t.Run("writes increase versions", func(t *testing.T) {
+		if err := db.Put("key1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		first := version("key1")
+		if err := db.Put("key2", "value2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key1", "value3"); err != nil {
+			t.Fatal(err)
+		}
+		if first == 0 || version("key2") <= first || version("key1") <= version("key2") {
+			t.Errorf("ERROR! Versions do not follow the writes: %d, %d, %d", first, version("key2"), version("key1"))
+		}
+	})
+
+	t.Run("batch entries share a version", func(t *testing.T) {
+		wb := new(WriteBatch)
+		wb.Put("key3", "value")
+		wb.Put("key4", "value")
+		if err := db.Batch(wb); err != nil {
+			t.Fatal(err)
+		}
+		if version("key3") != version("key4") || version("key3") <= version("key1") {
+			t.Errorf("ERROR! Bad batch versions: %d, %d", version("key3"), version("key4"))
+		}
+	})
+
+	t.Run("compare and swap", func(t *testing.T) {
+		current := version("key1")
+		if _, err := db.CompareAndSwap("key1", current-1, "stale"); err != ErrVersionMismatch {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrVersionMismatch, err)
+		}
+		next, err := db.CompareAndSwap("key1", current, "fresh")
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, v, err := db.GetWithVersion("key1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "fresh" || v != next || next <= current {
+			t.Errorf("ERROR!\nExpected: fresh (%d);\nGot: %v (%d)", next, value, v)
+		}
+
+		if _, err := db.CompareAndSwap("new", 1, "value"); err != ErrVersionMismatch {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrVersionMismatch, err)
+		}
+		if _, err := db.CompareAndSwap("new", 0, "value"); err != nil {
+			t.Errorf("ERROR! Can't create a key with version 0: %s", err)
+		}
+	})
+
+	t.Run("compare and delete", func(t *testing.T) {
+		if err := db.CompareAndDelete("missing", 0); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		current := version("key2")
+		if err := db.CompareAndDelete("key2", current+1); err != ErrVersionMismatch {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrVersionMismatch, err)
+		}
+		if err := db.CompareAndDelete("key2", current); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("key2"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	})
+
+	t.Run("concurrent updates are not lost", func(t *testing.T) {
+		if err := db.PutInt64("counter", 0); err != nil {
+			t.Fatal(err)
+		}
+		var (
+			wg        sync.WaitGroup
+			successMu sync.Mutex
+			successes int
+		)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					value, v, err := db.GetWithVersion("counter")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					var n int64
+					switch value := value.(type) {
+					case int64:
+						n = value
+					case string:
+						n, _ = strconv.ParseInt(value, 10, 64)
+					}
+					_, err = db.CompareAndSwap("counter", v, strconv.FormatInt(n+1, 10))
+					if err == ErrVersionMismatch {
+						continue
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					successMu.Lock()
+					successes++
+					successMu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		value, err := db.Get("counter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != strconv.Itoa(successes) {
+			t.Errorf("ERROR!\nExpected: %d;\nGot: %s", successes, value)
+		}
+	})
+
+	t.Run("versions survive restart and merge", func(t *testing.T) {
+		if err := db.Put("last", "value"); err != nil {
+			t.Fatal(err)
+		}
+		last := version("last")
+		if err := db.Delete("last"); err != nil {
+			t.Fatal(err)
+		}
+		db.SetCompactionPolicy(CompactionTrigger{MaxSegments: 1})
+		db.mu.Lock()
+		if err := db.addNewBlockToDB(); err != nil {
+			t.Fatal(err)
+		}
+		db.mu.Unlock()
+		if err := db.compact(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := db.blocks[0].index["last"]; ok {
+			t.Fatal("ERROR! The tombstone is still present in the merged block")
+		}
+
+		db.Close()
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !db.blocks[0].hinted {
+			t.Error("ERROR! The merged segment is scanned instead of loading its hint")
+		}
+		if err := db.Put("last", "again"); err != nil {
+			t.Fatal(err)
+		}
+		// The tombstone is dropped by the merge, but its version is not reused.
+		if v := version("last"); v <= last+1 {
+			t.Errorf("ERROR! Version %d is not greater than %d", v, last+1)
+		}
+	})
+}